@@ -1,14 +1,17 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"crypto/sha256"
 	"flag"
 	"fmt"
-	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/accesslog"
+	"httpfromtcp/internal/fileserver"
 	"httpfromtcp/internal/request"
 	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/router"
 	"httpfromtcp/internal/server"
+	"httpfromtcp/internal/templates"
 	"io"
 	"log"
 	"net/http"
@@ -16,246 +19,151 @@ import (
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 )
 
-const port = 42069
+const (
+	port            = 42069
+	shutdownTimeout = 10 * time.Second
+)
 
 func main() {
+	yourProblemHandler := func(w *response.Writer, req *request.Request) {
+		templates.WritePage(w, response.StatusBadRequest, templates.Page{
+			Title:   "400 Bad Request",
+			Heading: "Bad Request",
+			Message: "Your request honestly kinda sucked.",
+		})
+	}
+
+	myProblemHandler := func(w *response.Writer, req *request.Request) {
+		templates.WritePage(w, response.StatusInternalServerError, templates.Page{
+			Title:   "500 Internal Server Error",
+			Heading: "Internal Server Error",
+			Message: "Okay, you know what? This one is on me.",
+		})
+	}
+
 	handler := func(w *response.Writer, req *request.Request) {
-		switch req.RequestLine.RequestTarget {
-		case "/yourproblem":
-			w.WriteStatusLine(response.StatusBadRequest)
-			data := response.PageData{
-				Title:   "400 Bad Request",
-				Heading: "Bad Request",
-				Message: "Your request honestly kinda sucked.",
-			}
-			w.WriteHeaders(response.GetDefaultHeaders(data.ContentLength()))
-			w.WriteBody(data)
-		case "/myproblem":
-			w.WriteStatusLine(response.StatusInternalServerError)
-			data := response.PageData{
-				Title:   "500 Internal Server Error",
-				Heading: "Internal Server Error",
-				Message: "Okay, you know what? This one is on me.",
-			}
-			w.WriteHeaders(response.GetDefaultHeaders(data.ContentLength()))
-			w.WriteBody(data)
-		default:
-			w.WriteStatusLine(response.StatusOK)
-			data := response.PageData{
-				Title:   "200 OK",
-				Heading: "Success!",
-				Message: "Your request was an absolute banger.",
-			}
-			w.WriteHeaders(response.GetDefaultHeaders(data.ContentLength()))
-			w.WriteBody(data)
-		}
+		templates.WritePage(w, response.StatusOK, templates.Page{
+			Title:   "200 OK",
+			Heading: "Success!",
+			Message: "Your request was an absolute banger.",
+		})
 	}
 
-	httpbinHandler := func(w *response.Writer, req *request.Request) {
-		if !strings.HasPrefix(req.RequestLine.RequestTarget, "/httpbin/") {
-			w.WriteStatusLine(response.StatusBadRequest)
-			data := response.PageData{
-				Title:   "400 Bad Request",
-				Heading: "Unsupported Request",
-				Message: "Your request honestly kinda sucked! Only /httpbin/ requests are supported.",
-			}
-			w.WriteHeaders(response.GetDefaultHeaders(data.ContentLength()))
-			w.WriteBody(data)
-			return
-		}
+	httpbinHandler := func(w *response.ResponseWriter, req *request.Request) {
 		// Handle the request here
-		// Trim the "/httpbin/" prefix
-		target := strings.TrimPrefix(req.RequestLine.RequestTarget, "/httpbin/")
-		// Create Headers
-		chunkedHeaders := headers.Headers{
-			"Content-Type":      "text/html",
-			"Transfer-Encoding": "chunked",
-			"Connection":        "close",
-			"Trailer":           "X-Content-SHA256, X-Content-Length",
+		// Trim the "/httpbin/" prefix, the router only sends those requests here
+		target := strings.TrimPrefix(req.URL.Path, "/httpbin/")
+		if req.URL.RawQuery != "" {
+			target += "?" + req.URL.RawQuery
 		}
 		// Get request to httpbin.org
-		resp, err := http.Get("https://httpbin.org/" + target)
+		// Stop proxying as soon as the client goes away
+		httpbinReq, err := http.NewRequestWithContext(req.Context(), http.MethodGet, "https://httpbin.org/"+target, nil)
 		if err != nil {
-			w.WriteStatusLine(response.StatusInternalServerError)
-			data := response.PageData{
-				Title:   "500 Internal Server Error",
-				Heading: "Internal Server Error",
-				Message: "httpbin.org is unresponsive.",
-			}
-			w.WriteHeaders(response.GetDefaultHeaders(data.ContentLength()))
-			w.WriteBody(data)
+			templates.WriteMessage(w, response.StatusBadRequest, "Couldn't build the httpbin.org request.")
 			return
 		}
-
-		totalBytesRead := 0
-		// store the full response from httpbin.org in a bytes.Buffer{}
-		httpbinResponseBody := &bytes.Buffer{}
-		// read the response from httpbin.org and store it in a 1024 bytes buffer
-		buf := make([]byte, 1024)
-		for {
-			bytesRead, err := resp.Body.Read(buf)
-			if err == io.EOF {
-				break
-			}
-			if err != nil {
-				w.WriteStatusLine(response.StatusInternalServerError)
-				data := response.PageData{
-					Title:   "500 Internal Server Error",
-					Heading: "Internal Server Error",
-					Message: "Couldn't read httpbin.org's response!",
-				}
-				w.WriteHeaders(response.GetDefaultHeaders(data.ContentLength()))
-				w.WriteBody(data)
-				return
-			}
-			// store read bytes in totalBytesRead
-			totalBytesRead += bytesRead
-			log.Println("Bytes Read: ", bytesRead) //watchout n is in hex
-			// append buf to responseBody - full response buffer
-			httpbinResponseBody.Write(buf[:bytesRead])
-			// Write each chunk read
-			w.WriteStatusLine(response.StatusOK)
-			w.WriteHeaders(chunkedHeaders)
-			_, err = w.WriteChunkedBody(buf)
-			if err != nil {
-				w.WriteStatusLine(response.StatusInternalServerError)
-				data := response.PageData{
-					Title:   "500 Internal Server Error",
-					Heading: "Internal Server Error",
-					Message: "Couldn't write part of the body!",
-				}
-				w.WriteHeaders(response.GetDefaultHeaders(data.ContentLength()))
-				w.WriteBody(data)
-				return
-			}
-		}
-		// Write the suffix for the chunked data
-		_, err = w.WriteChunkedBodyDone()
+		resp, err := http.DefaultClient.Do(httpbinReq)
 		if err != nil {
-			w.WriteStatusLine(response.StatusInternalServerError)
-			data := response.PageData{
-				Title:   "500 Internal Server Error",
-				Heading: "Internal Server Error",
-				Message: "Couldn't write CRLF to end the body!",
-			}
-			w.WriteHeaders(response.GetDefaultHeaders(data.ContentLength()))
-			w.WriteBody(data)
+			templates.WriteMessage(w, response.StatusInternalServerError, "httpbin.org is unresponsive.")
 			return
 		}
-		// Calculate the hash of the response body
-		hash := sha256.Sum256(httpbinResponseBody.Bytes())
-		// Create Trailer Headers
-		trailers := headers.Headers{
-			"X-Content-SHA256": fmt.Sprintf("%x", hash),
-			"X-Content-Length": fmt.Sprintf("%d", totalBytesRead),
-		}
-		// Write Trailer Headers
-		err = w.WriteTrailers(trailers)
+		defer resp.Body.Close()
+
+		// Stream the response through, the declared trailers make it chunked
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Trailer", "X-Content-SHA256, X-Content-Length")
+		hash := sha256.New()
+		totalBytesRead, err := io.Copy(io.MultiWriter(w, hash), resp.Body)
 		if err != nil {
-			w.WriteStatusLine(response.StatusInternalServerError)
-			data := response.PageData{
-				Title:   "500 Internal Server Error",
-				Heading: "Internal Server Error",
-				Message: "Couldn't write trailers",
-			}
-			w.WriteHeaders(response.GetDefaultHeaders(data.ContentLength()))
-			w.WriteBody(data)
+			// The body is cut short, leave out the trailers so the client can tell
+			log.Println("Error proxying httpbin.org:", err)
 			return
 		}
+		// Calculate the hash of the response body and send it as trailers
+		w.Trailer().Set("X-Content-SHA256", fmt.Sprintf("%x", hash.Sum(nil)))
+		w.Trailer().Set("X-Content-Length", fmt.Sprintf("%d", totalBytesRead))
 	}
 
-	videoHandler := func(w *response.Writer, req *request.Request) {
-		if req.RequestLine.RequestTarget != "/video" {
-			w.WriteStatusLine(response.StatusBadRequest)
-			data := response.PageData{
-				Title:   "400 Bad Request",
-				Heading: "Unsupported Request",
-				Message: "Your request honestly kinda sucked! Only /video requests are supported.",
-			}
-			w.WriteHeaders(response.GetDefaultHeaders(data.ContentLength()))
-			w.WriteBody(data)
-			return
-		}
-
+	videoHandler := func(w *response.ResponseWriter, req *request.Request) {
 		// Respond with the assets/vim.mp4 video
 		videoPath := "assets/vim.mp4"
 		videoFile, err := os.Open(videoPath)
 		if err != nil {
-			w.WriteStatusLine(response.StatusInternalServerError)
-			data := response.PageData{
-				Title:   "500 Internal Server Error",
-				Heading: "Internal Server Error",
-				Message: "Couldn't open the video file.",
-			}
-			w.WriteHeaders(response.GetDefaultHeaders(data.ContentLength()))
-			w.WriteBody(data)
+			templates.WriteMessage(w, response.StatusInternalServerError, "Couldn't open the video file.")
 			return
 		}
 		defer videoFile.Close()
 
-		// Get the file info to determine the size
+		// Get the file info for the modification time
 		videoInfo, err := videoFile.Stat()
 		if err != nil {
-			w.WriteStatusLine(response.StatusInternalServerError)
-			data := response.PageData{
-				Title:   "500 Internal Server Error",
-				Heading: "Internal Server Error",
-				Message: "Couldn't retrieve video file info.",
-			}
-			w.WriteHeaders(response.GetDefaultHeaders(data.ContentLength()))
-			w.WriteBody(data)
+			templates.WriteMessage(w, response.StatusInternalServerError, "Couldn't retrieve video file info.")
 			return
 		}
 
-		// Set headers for video response
-		headers := headers.Headers{
-			"Content-Type":   "video/mp4",
-			"Content-Length": fmt.Sprintf("%d", videoInfo.Size()),
-		}
-		w.WriteStatusLine(response.StatusOK)
-		w.WriteHeaders(headers)
-
-		// Stream the video file to the response
-		_, err = io.Copy(w, videoFile)
-		if err != nil {
-			log.Printf("Error streaming video: %v", err)
-		}
+		// Seeking and resuming need byte ranges
+		w.Header().Set("Content-Type", "video/mp4")
+		fileserver.ServeContent(w, req, videoInfo.ModTime(), videoFile)
 	}
 
-	//========================== HANDLER SELECTION ===================================
-	//Use flag -t to enable the test handler
-	//Use flag -v to enable the video handler
-	//Use no flag to enable the chunked encoding handler
-	useTestHandler := flag.Bool("t", false, "use test handler")
-	useVideoHandler := flag.Bool("v", false, "use video handler")
+	//========================== ROUTES ===================================
+	mux := router.New()
+	mux.Handle("/yourproblem", yourProblemHandler)
+	mux.Handle("/myproblem", myProblemHandler)
+	mux.Handle("/httpbin/*", server.Adapt(httpbinHandler))
+	mux.Handle("GET /video", server.Adapt(videoHandler))
+	assets := fileserver.New(os.DirFS("assets"), fileserver.Options{Prefix: "/assets/", Listing: true})
+	mux.Handle("GET /assets/*", server.Adapt(assets.ServeHTTP))
+	mux.Handle("/*", handler)
+
+	//========================== ACCESS LOG ===================================
+	//Use flag -access-log to choose the log file ("-" for stdout, "" to disable)
+	//Use flag -access-log-format to choose between common, combined and json
+	accessLogPath := flag.String("access-log", "-", "access log file, - for stdout, empty to disable")
+	accessLogFormat := flag.String("access-log-format", "common", "access log format: common, combined or json")
 	flag.Parse()
-	if *useTestHandler { // test handler
-		server, err := server.Serve(port, handler)
-		if err != nil {
-			log.Fatalf("Error starting server: %v", err)
-		}
-		defer server.Close()
-		log.Println("Server started on port", port, "in Testing Mode")
-	} else if *useVideoHandler { // video handler
-		server, err := server.Serve(port, videoHandler)
+
+	var middlewares []server.Middleware
+	if *accessLogPath != "" {
+		format, err := accesslog.ParseFormat(*accessLogFormat)
 		if err != nil {
-			log.Fatalf("Error starting server: %v", err)
+			log.Fatalf("Error configuring access log: %v", err)
 		}
-		defer server.Close()
-		log.Println("Server started on port", port, "in Video Mode")
-	} else { // chunked encoding handler
-		server, err := server.Serve(port, httpbinHandler)
-		if err != nil {
-			log.Fatalf("Error starting server: %v", err)
+		var out io.Writer = os.Stdout
+		if *accessLogPath != "-" {
+			// Reopened on SIGHUP so the file can be rotated
+			logFile, err := accesslog.OpenFile(*accessLogPath)
+			if err != nil {
+				log.Fatalf("Error opening access log: %v", err)
+			}
+			defer logFile.Close()
+			out = logFile
 		}
-		defer server.Close()
-		log.Println("Server started on port", port, "in Chunked Encoding Mode")
+		middlewares = append(middlewares, accesslog.New(out, format).Middleware)
+	}
+
+	config := server.DefaultConfig(port)
+	config.Defaults.Server = "httpfromtcp"
+	srv, err := server.ServeConfig(config, server.Chain(mux.ServeHTTP, middlewares...))
+	if err != nil {
+		log.Fatalf("Error starting server: %v", err)
 	}
+	log.Println("Server started on port", port)
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	<-sigChan
+
+	// Give in-flight requests a chance to finish before exiting
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Println("Error shutting down server:", err)
+		return
+	}
 	log.Println("Server gracefully stopped")
 }
@@ -0,0 +1,176 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type Format int
+
+const (
+	FormatCommon   Format = iota // Common Log Format
+	FormatCombined               // Common Log Format plus referer and user agent
+	FormatJSON                   // one JSON object per line
+)
+
+// Layout of the timestamp in Common and Combined Log Format
+const clfTimeLayout = "02/Jan/2006:15:04:05 -0700"
+
+// ParseFormat converts "common", "combined" or "json" to a Format
+func ParseFormat(name string) (Format, error) {
+	switch name {
+	case "common":
+		return FormatCommon, nil
+	case "combined":
+		return FormatCombined, nil
+	case "json":
+		return FormatJSON, nil
+	default:
+		return 0, fmt.Errorf("unknown access log format %q", name)
+	}
+}
+
+// Entry is one served request
+type Entry struct {
+	Time       time.Time
+	RemoteAddr string
+	Method     string
+	Target     string
+	Version    string
+	StatusCode int
+	Bytes      int64
+	Duration   time.Duration
+	Referer    string
+	UserAgent  string
+}
+
+// Logger writes one line per request to an io.Writer. It is safe for
+// concurrent use.
+type Logger struct {
+	mu     sync.Mutex
+	out    io.Writer
+	format Format
+}
+
+func New(out io.Writer, format Format) *Logger {
+	return &Logger{
+		out:    out,
+		format: format,
+	}
+}
+
+// Middleware logs every request once the wrapped handler returns, or panics.
+// The status is the one the server sends: 500 for a panic before anything
+// was written, 200 for a handler that wrote nothing. Use it with
+// server.Chain.
+func (l *Logger) Middleware(next server.Handler) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		start := time.Now()
+		panicked := true
+		defer func() {
+			statusCode := w.StatusCode()
+			if statusCode == 0 && panicked {
+				statusCode = response.StatusInternalServerError
+			} else if statusCode == 0 {
+				statusCode = response.StatusOK
+			}
+			referer, _ := req.Headers.Get("referer")
+			userAgent, _ := req.Headers.Get("user-agent")
+			err := l.Log(Entry{
+				Time:       start,
+				RemoteAddr: req.RemoteAddr,
+				Method:     req.RequestLine.Method,
+				Target:     req.RequestLine.RequestTarget,
+				Version:    req.RequestLine.HttpVersion,
+				StatusCode: int(statusCode),
+				Bytes:      w.BytesWritten(),
+				Duration:   time.Since(start),
+				Referer:    referer,
+				UserAgent:  userAgent,
+			})
+			if err != nil {
+				// Losing a log line must not affect the response
+				log.Println("Error writing access log:", err)
+			}
+		}()
+		next(w, req)
+		panicked = false
+	}
+}
+
+// Log writes e in the logger's format
+func (l *Logger) Log(e Entry) error {
+	var line []byte
+	switch l.format {
+	case FormatJSON:
+		var err error
+		line, err = json.Marshal(jsonEntry{
+			Time:       e.Time.Format(time.RFC3339Nano),
+			RemoteAddr: e.RemoteAddr,
+			Method:     e.Method,
+			Target:     e.Target,
+			Version:    e.Version,
+			StatusCode: e.StatusCode,
+			Bytes:      e.Bytes,
+			DurationMs: float64(e.Duration) / float64(time.Millisecond),
+			Referer:    e.Referer,
+			UserAgent:  e.UserAgent,
+		})
+		if err != nil {
+			return err
+		}
+	case FormatCombined:
+		line = fmt.Appendf(nil, "%s %q %q", commonLine(e), orDash(e.Referer), orDash(e.UserAgent))
+	default:
+		line = []byte(commonLine(e))
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err := l.out.Write(line)
+	return err
+}
+
+type jsonEntry struct {
+	Time       string  `json:"time"`
+	RemoteAddr string  `json:"remote_addr"`
+	Method     string  `json:"method"`
+	Target     string  `json:"target"`
+	Version    string  `json:"version"`
+	StatusCode int     `json:"status"`
+	Bytes      int64   `json:"bytes"`
+	DurationMs float64 `json:"duration_ms"`
+	Referer    string  `json:"referer,omitempty"`
+	UserAgent  string  `json:"user_agent,omitempty"`
+}
+
+// commonLine formats e as: host ident authuser [date] "request line" status bytes
+func commonLine(e Entry) string {
+	host := e.RemoteAddr
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	bytes := "-"
+	if e.Bytes > 0 {
+		bytes = strconv.FormatInt(e.Bytes, 10)
+	}
+	requestLine := fmt.Sprintf("%s %s HTTP/%s", e.Method, e.Target, e.Version)
+	return fmt.Sprintf("%s - - [%s] %q %d %s", orDash(host), e.Time.Format(clfTimeLayout), requestLine, e.StatusCode, bytes)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
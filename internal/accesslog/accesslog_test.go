@@ -0,0 +1,117 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLog(t *testing.T) {
+	entry := Entry{
+		Time:       time.Date(2000, time.October, 10, 13, 55, 36, 0, time.FixedZone("", -7*60*60)),
+		RemoteAddr: "127.0.0.1:53412",
+		Method:     "GET",
+		Target:     "/apache_pb.gif",
+		Version:    "1.1",
+		StatusCode: 200,
+		Bytes:      2326,
+		Duration:   1500 * time.Microsecond,
+		Referer:    "http://www.example.com/start.html",
+		UserAgent:  "Mozilla/4.08",
+	}
+
+	// Test: Common Log Format
+	out := &bytes.Buffer{}
+	require.NoError(t, New(out, FormatCommon).Log(entry))
+	assert.Equal(t, `127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.1" 200 2326`+"\n", out.String())
+
+	// Test: Combined Log Format
+	out.Reset()
+	require.NoError(t, New(out, FormatCombined).Log(entry))
+	assert.Equal(t, `127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.1" 200 2326 "http://www.example.com/start.html" "Mozilla/4.08"`+"\n", out.String())
+
+	// Test: Empty body and missing headers are logged as "-"
+	out.Reset()
+	entry.Bytes, entry.Referer, entry.UserAgent = 0, "", ""
+	require.NoError(t, New(out, FormatCombined).Log(entry))
+	assert.Equal(t, `127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.1" 200 - "-" "-"`+"\n", out.String())
+
+	// Test: JSON lines
+	out.Reset()
+	require.NoError(t, New(out, FormatJSON).Log(entry))
+	var fields map[string]any
+	require.NoError(t, json.Unmarshal(out.Bytes(), &fields))
+	assert.Equal(t, "127.0.0.1:53412", fields["remote_addr"])
+	assert.Equal(t, "/apache_pb.gif", fields["target"])
+	assert.Equal(t, float64(200), fields["status"])
+	assert.Equal(t, 1.5, fields["duration_ms"])
+	assert.NotContains(t, fields, "user_agent")
+}
+
+func TestMiddleware(t *testing.T) {
+	out := &bytes.Buffer{}
+	logger := New(out, FormatCommon)
+	serve := func(h func(w *response.Writer, req *request.Request)) string {
+		out.Reset()
+		req, err := request.RequestFromReader(strings.NewReader("GET /x HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		require.NoError(t, err)
+		logger.Middleware(h)(response.NewWriter(io.Discard), req)
+		return out.String()
+	}
+
+	// Test: Status and body size written by the handler
+	line := serve(func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusNotFound)
+		w.WriteHeaders(response.GetDefaultHeaders(4))
+		w.WriteBody([]byte("nope"))
+	})
+	assert.Contains(t, line, `"GET /x HTTP/1.1" 404 4`)
+
+	// Test: A handler writing nothing is logged with the empty 200 it gets
+	line = serve(func(w *response.Writer, req *request.Request) {})
+	assert.Contains(t, line, `"GET /x HTTP/1.1" 200 -`)
+
+	// Test: A panic is logged as a 500 and still reaches the server
+	assert.PanicsWithValue(t, "boom", func() {
+		serve(func(w *response.Writer, req *request.Request) { panic("boom") })
+	})
+	assert.Contains(t, out.String(), `"GET /x HTTP/1.1" 500 -`)
+}
+
+func TestFileReopen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	lf, err := OpenFile(path)
+	require.NoError(t, err)
+	defer lf.Close()
+
+	// Test: Lines are appended to the file
+	_, err = lf.Write([]byte("first\n"))
+	require.NoError(t, err)
+
+	// Test: After the file is moved away, Reopen starts a new one
+	rotated := filepath.Join(dir, "access.log.1")
+	require.NoError(t, os.Rename(path, rotated))
+	_, err = lf.Write([]byte("second\n"))
+	require.NoError(t, err)
+	require.NoError(t, lf.Reopen())
+	_, err = lf.Write([]byte("third\n"))
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(rotated)
+	require.NoError(t, err)
+	assert.Equal(t, "first\nsecond\n", string(data))
+	data, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "third\n", string(data))
+}
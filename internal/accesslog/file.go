@@ -0,0 +1,75 @@
+package accesslog
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// File is an append-only log file that can be reopened, so an external tool
+// like logrotate can move it away and signal the server with SIGHUP.
+type File struct {
+	mu      sync.Mutex
+	path    string
+	f       *os.File
+	signals chan os.Signal
+}
+
+// OpenFile opens path for appending and reopens it whenever the process
+// receives SIGHUP
+func OpenFile(path string) (*File, error) {
+	f, err := openAppend(path)
+	if err != nil {
+		return nil, err
+	}
+	lf := &File{
+		path:    path,
+		f:       f,
+		signals: make(chan os.Signal, 1),
+	}
+	signal.Notify(lf.signals, syscall.SIGHUP)
+	go func() {
+		for range lf.signals {
+			if err := lf.Reopen(); err != nil {
+				// Keep writing to the old file rather than losing lines
+				log.Println("Error reopening access log:", err)
+			}
+		}
+	}()
+	return lf, nil
+}
+
+func (lf *File) Write(p []byte) (int, error) {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	return lf.f.Write(p)
+}
+
+// Reopen closes the current file and opens path again, creating it if it was
+// moved away
+func (lf *File) Reopen() error {
+	f, err := openAppend(lf.path)
+	if err != nil {
+		return err
+	}
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	old := lf.f
+	lf.f = f
+	return old.Close()
+}
+
+// Close stops listening for SIGHUP and closes the file
+func (lf *File) Close() error {
+	signal.Stop(lf.signals)
+	close(lf.signals)
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	return lf.f.Close()
+}
+
+func openAppend(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+}
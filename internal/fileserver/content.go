@@ -0,0 +1,244 @@
+package fileserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/templates"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxRanges is how many ranges one request may ask for before the Range
+// header is ignored and the whole content sent
+const maxRanges = 64
+
+var errUnsatisfiable = errors.New("fileserver: no range overlaps the content")
+
+// byteRange is a range of content, already clamped to its size
+type byteRange struct {
+	start, length int64
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// ServeContent replies to req with content, whole or in the byte ranges asked
+// for by a Range header:
+//   - a single range gets a 206 with Content-Range
+//   - several ranges get a 206 with a multipart/byteranges body
+//   - ranges entirely past the end get a 416
+//   - an If-Range that doesn't match the ETag header or modtime gets it all
+//
+// Accept-Ranges is always set, and Last-Modified unless modtime is zero. The
+// Content-Type set by the caller, if any, is kept, and the content of a HEAD
+// response is not read.
+func ServeContent(w *response.ResponseWriter, req *request.Request, modtime time.Time, content io.ReadSeeker) {
+	size, err := content.Seek(0, io.SeekEnd)
+	if err != nil {
+		templates.WriteMessage(w, response.StatusInternalServerError, "The content could not be read.")
+		return
+	}
+
+	h := w.Header()
+	h.Set("Accept-Ranges", "bytes")
+	if _, ok := h.Get("Last-Modified"); !ok && !modtime.IsZero() {
+		h.Set("Last-Modified", response.FormatDate(modtime))
+	}
+	if _, ok := h.Get("Content-Type"); !ok {
+		h.Set("Content-Type", "application/octet-stream")
+	}
+
+	// Ranges only make sense for GET, and HEAD which mirrors it
+	var ranges []byteRange
+	method := req.RequestLine.Method
+	if value, ok := req.Headers.Get("Range"); ok && (method == "GET" || method == "HEAD") && ifRangeMatches(req, h, modtime) {
+		ranges, err = parseRange(value, size)
+		if err != nil {
+			h.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			templates.WriteMessage(w, response.StatusRangeNotSatisfiable, "The requested range is past the end of the content.")
+			return
+		}
+	}
+
+	sendBody := method != "HEAD"
+	switch len(ranges) {
+	case 0:
+		h.Set("Content-Length", strconv.FormatInt(size, 10))
+		w.WriteHeader(response.StatusOK)
+		if sendBody {
+			copyRange(w, content, byteRange{0, size})
+		}
+	case 1:
+		h.Set("Content-Range", ranges[0].contentRange(size))
+		h.Set("Content-Length", strconv.FormatInt(ranges[0].length, 10))
+		w.WriteHeader(response.StatusPartialContent)
+		if sendBody {
+			copyRange(w, content, ranges[0])
+		}
+	default:
+		writeMultipart(w, content, ranges, size, sendBody)
+	}
+}
+
+// writeMultipart sends ranges as a multipart/byteranges body. The part
+// headers are built first so the Content-Length is known.
+func writeMultipart(w *response.ResponseWriter, content io.ReadSeeker, ranges []byteRange, size int64, sendBody bool) {
+	h := w.Header()
+	contentType, _ := h.Get("Content-Type")
+	boundary := randomBoundary()
+
+	partHeaders := make([]string, len(ranges))
+	length := int64(0)
+	for i, r := range ranges {
+		// Every part but the first ends the previous one with a CRLF
+		delimiter := "--" + boundary
+		if i > 0 {
+			delimiter = "\r\n" + delimiter
+		}
+		partHeaders[i] = fmt.Sprintf("%s\r\nContent-Type: %s\r\nContent-Range: %s\r\n\r\n", delimiter, contentType, r.contentRange(size))
+		length += int64(len(partHeaders[i])) + r.length
+	}
+	closing := "\r\n--" + boundary + "--\r\n"
+	length += int64(len(closing))
+
+	h.Set("Content-Type", "multipart/byteranges; boundary="+boundary)
+	h.Set("Content-Length", strconv.FormatInt(length, 10))
+	w.WriteHeader(response.StatusPartialContent)
+	if !sendBody {
+		return
+	}
+	for i, r := range ranges {
+		if _, err := io.WriteString(w, partHeaders[i]); err != nil {
+			return
+		}
+		if !copyRange(w, content, r) {
+			return
+		}
+	}
+	io.WriteString(w, closing)
+}
+
+// copyRange sends one range of content and reports whether it all went out.
+// A failure cuts the body short, which closes the connection.
+func copyRange(w io.Writer, content io.ReadSeeker, r byteRange) bool {
+	if _, err := content.Seek(r.start, io.SeekStart); err != nil {
+		log.Println("Error seeking content:", err)
+		return false
+	}
+	if _, err := io.CopyN(w, content, r.length); err != nil {
+		log.Println("Error sending content:", err)
+		return false
+	}
+	return true
+}
+
+// parseRange parses a Range header value for content of size bytes. It
+// returns no ranges if the header should be ignored: another unit than
+// bytes, a malformed range, too many ranges or more bytes than the content
+// itself, as overlapping ranges can ask for. Ranges starting past the end are
+// skipped, and if that leaves none errUnsatisfiable is returned.
+func parseRange(value string, size int64) ([]byteRange, error) {
+	specs, ok := strings.CutPrefix(value, "bytes=")
+	if !ok {
+		return nil, nil
+	}
+
+	var ranges []byteRange
+	count, total := 0, int64(0)
+	for _, spec := range strings.Split(specs, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		if count++; count > maxRanges {
+			return nil, nil
+		}
+		first, last, ok := strings.Cut(spec, "-")
+		if !ok {
+			return nil, nil
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+
+		var r byteRange
+		if first == "" {
+			// A suffix range, the last n bytes
+			n, ok := parseDigits(last)
+			if !ok {
+				return nil, nil
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+			r = byteRange{start: max(size-n, 0), length: min(n, size)}
+		} else {
+			start, ok := parseDigits(first)
+			if !ok {
+				return nil, nil
+			}
+			end := size - 1
+			if last != "" {
+				if end, ok = parseDigits(last); !ok || end < start {
+					return nil, nil
+				}
+			}
+			if start >= size {
+				continue
+			}
+			r = byteRange{start: start, length: min(end, size-1) - start + 1}
+		}
+		ranges = append(ranges, r)
+		total += r.length
+	}
+
+	if count == 0 || total > size {
+		return nil, nil
+	}
+	if len(ranges) == 0 {
+		return nil, errUnsatisfiable
+	}
+	return ranges, nil
+}
+
+// parseDigits parses a non-negative decimal number made of digits only
+func parseDigits(s string) (int64, bool) {
+	if s == "" || strings.TrimLeft(s, "0123456789") != "" {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	return n, err == nil
+}
+
+// ifRangeMatches reports whether the Range header applies: there is no
+// If-Range, or it names the current representation by a strong ETag or by
+// its exact Last-Modified date.
+func ifRangeMatches(req *request.Request, h *headers.Headers, modtime time.Time) bool {
+	value, ok := req.Headers.Get("If-Range")
+	if !ok {
+		return true
+	}
+	// Weak validators never match
+	if strings.HasPrefix(value, `"`) {
+		etag, ok := h.Get("ETag")
+		return ok && etag == value
+	}
+	if strings.HasPrefix(value, "W/") {
+		return false
+	}
+	t, err := response.ParseDate(value)
+	return err == nil && !modtime.IsZero() && t.Equal(modtime.Truncate(time.Second))
+}
+
+func randomBoundary() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
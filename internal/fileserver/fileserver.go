@@ -0,0 +1,320 @@
+package fileserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/templates"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const indexFile = "index.html"
+
+// Options configure a FileServer
+type Options struct {
+	// Prefix is the URL path the files are served under, e.g. "/static/".
+	// Requests outside of it get a 404. Empty means "/".
+	Prefix string
+	// Listing enables listings of directories without an index.html, as
+	// HTML or, for clients asking for it in Accept, as JSON. Without it such
+	// directories get a 403.
+	Listing bool
+}
+
+// FileServer serves the files of an fs.FS, such as os.DirFS or an embed.FS:
+//   - the content type comes from the extension, or else from sniffing
+//   - a directory is served by its index.html, or by a listing if enabled
+//   - a "name.gz" next to a file is sent instead to clients accepting gzip
+//   - ranges, Last-Modified and HEAD are handled by ServeContent
+//
+// Paths can't leave the root of the file system, whatever the request target.
+type FileServer struct {
+	fsys    fs.FS
+	prefix  string
+	listing bool
+}
+
+// Entry is a file in a directory listing
+type Entry struct {
+	Name     string    `json:"name"`
+	URL      string    `json:"url"` // relative to the directory
+	Dir      bool      `json:"dir"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// Listing is the data of the directory listing page
+type Listing struct {
+	Path    string  // URL path of the directory
+	Parent  bool    // the directory is not the root
+	Entries []Entry // sorted by name
+}
+
+func New(fsys fs.FS, opts Options) *FileServer {
+	prefix := opts.Prefix
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return &FileServer{fsys: fsys, prefix: prefix, listing: opts.Listing}
+}
+
+// ServeHTTP serves the file named by the request path. Use it with
+// server.Adapt.
+func (s *FileServer) ServeHTTP(w *response.ResponseWriter, req *request.Request) {
+	if method := req.RequestLine.Method; method != "GET" && method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		templates.WriteMessage(w, response.StatusMethodNotAllowed, "The requested resource does not support this method.")
+		return
+	}
+
+	// The request path is already decoded and cleaned, so ".." can't climb
+	// out of the prefix. What is left must still be a valid fs.FS name.
+	urlPath := req.URL.Path
+	if urlPath+"/" == s.prefix {
+		redirect(w, req, path.Base(urlPath)+"/")
+		return
+	}
+	rest, ok := strings.CutPrefix(urlPath, s.prefix)
+	if !ok {
+		templates.WriteMessage(w, response.StatusNotFound, "The requested resource could not be found.")
+		return
+	}
+	name := strings.TrimSuffix(rest, "/")
+	if name == "" {
+		name = "."
+	}
+	if !fs.ValidPath(name) || strings.ContainsAny(name, "\\\x00") {
+		templates.WriteMessage(w, response.StatusNotFound, "The requested resource could not be found.")
+		return
+	}
+
+	info, err := fs.Stat(s.fsys, name)
+	if err != nil {
+		writeFSError(w, err)
+		return
+	}
+	trailingSlash := strings.HasSuffix(urlPath, "/")
+	if !info.IsDir() {
+		if trailingSlash {
+			redirect(w, req, "../"+path.Base(name))
+			return
+		}
+		s.serveFile(w, req, name, info)
+		return
+	}
+
+	// Relative links in the directory only work with the trailing slash
+	if !trailingSlash {
+		redirect(w, req, path.Base(urlPath)+"/")
+		return
+	}
+	index := path.Join(name, indexFile)
+	if indexInfo, err := fs.Stat(s.fsys, index); err == nil && !indexInfo.IsDir() {
+		s.serveFile(w, req, index, indexInfo)
+		return
+	}
+	if !s.listing {
+		templates.WriteMessage(w, response.StatusForbidden, "Listing this directory is not allowed.")
+		return
+	}
+	s.serveListing(w, req, name, urlPath)
+}
+
+// serveFile sends the file name, or its gzipped sibling when the client
+// accepts gzip
+func (s *FileServer) serveFile(w *response.ResponseWriter, req *request.Request, name string, info fs.FileInfo) {
+	h := w.Header()
+	if gzInfo, err := fs.Stat(s.fsys, name+".gz"); err == nil && gzInfo.Mode().IsRegular() {
+		// The response depends on Accept-Encoding whichever file is sent
+		h.Add("Vary", "Accept-Encoding")
+		if encoding, _ := req.Headers.Get("Accept-Encoding"); acceptsGzip(encoding) {
+			if _, ok := h.Get("Content-Type"); !ok {
+				h.Set("Content-Type", s.contentType(name))
+			}
+			h.Set("Content-Encoding", "gzip")
+			name, info = name+".gz", gzInfo
+		}
+	}
+
+	f, err := s.fsys.Open(name)
+	if err != nil {
+		writeFSError(w, err)
+		return
+	}
+	defer f.Close()
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		// Ranges need to seek, keep the whole file in memory instead
+		data, err := io.ReadAll(f)
+		if err != nil {
+			writeFSError(w, err)
+			return
+		}
+		content = bytes.NewReader(data)
+	}
+
+	if _, ok := h.Get("Content-Type"); !ok {
+		contentType := mime.TypeByExtension(path.Ext(name))
+		if contentType == "" {
+			head := make([]byte, sniffLen)
+			n, _ := io.ReadFull(content, head)
+			if _, err := content.Seek(0, io.SeekStart); err != nil {
+				writeFSError(w, err)
+				return
+			}
+			contentType = detectContentType(head[:n])
+		}
+		h.Set("Content-Type", contentType)
+	}
+	ServeContent(w, req, info.ModTime(), content)
+}
+
+// contentType returns the content type of the file name, opening it to sniff
+// its content if the extension doesn't tell
+func (s *FileServer) contentType(name string) string {
+	if contentType := mime.TypeByExtension(path.Ext(name)); contentType != "" {
+		return contentType
+	}
+	f, err := s.fsys.Open(name)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	defer f.Close()
+	head := make([]byte, sniffLen)
+	n, _ := io.ReadFull(f, head)
+	return detectContentType(head[:n])
+}
+
+// serveListing sends the entries of the directory name as an HTML page, or as
+// JSON to clients preferring it
+func (s *FileServer) serveListing(w *response.ResponseWriter, req *request.Request, name, urlPath string) {
+	dirEntries, err := fs.ReadDir(s.fsys, name)
+	if err != nil {
+		writeFSError(w, err)
+		return
+	}
+	listing := Listing{Path: urlPath, Parent: name != ".", Entries: make([]Entry, 0, len(dirEntries))}
+	for _, de := range dirEntries {
+		info, err := de.Info()
+		if err != nil {
+			continue
+		}
+		// "./" keeps a name like "a:b" from reading as a scheme
+		entry := Entry{Name: de.Name(), URL: "./" + url.PathEscape(de.Name()), Dir: de.IsDir(), Modified: info.ModTime().UTC()}
+		if entry.Dir {
+			entry.URL += "/"
+		} else {
+			entry.Size = info.Size()
+		}
+		listing.Entries = append(listing.Entries, entry)
+	}
+
+	var body []byte
+	if accept, _ := req.Headers.Get("Accept"); prefersJSON(accept) {
+		body, err = json.Marshal(listing.Entries)
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		body, err = templates.Default().Render(templates.DefaultLayout, templates.ListingPage, listing)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	}
+	if err != nil {
+		log.Println("Error rendering listing:", err)
+		templates.WriteMessage(w, response.StatusInternalServerError, "The directory could not be listed.")
+		return
+	}
+	// Listings change with the directory, don't let them be cached as files
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Vary", "Accept")
+	w.Write(body)
+}
+
+// redirect sends a 301 to target, relative to the request path, keeping the
+// query
+func redirect(w *response.ResponseWriter, req *request.Request, target string) {
+	target = (&url.URL{Path: target}).EscapedPath()
+	if !strings.HasPrefix(target, "../") {
+		target = "./" + target
+	}
+	if req.URL.RawQuery != "" {
+		target += "?" + req.URL.RawQuery
+	}
+	h := w.Header()
+	h.Set("Location", target)
+	h.Set("Content-Length", "0")
+	w.WriteHeader(response.StatusMovedPermanently)
+}
+
+// writeFSError maps an error from the file system to a response
+func writeFSError(w *response.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, fs.ErrNotExist), errors.Is(err, fs.ErrInvalid):
+		templates.WriteMessage(w, response.StatusNotFound, "The requested resource could not be found.")
+	case errors.Is(err, fs.ErrPermission):
+		templates.WriteMessage(w, response.StatusForbidden, "Access to the requested resource is not allowed.")
+	default:
+		log.Println("Error serving file:", err)
+		templates.WriteMessage(w, response.StatusInternalServerError, "The file could not be read.")
+	}
+}
+
+// acceptsGzip reports whether an Accept-Encoding value allows gzip, by name or
+// by "*", with a non-zero quality
+func acceptsGzip(value string) bool {
+	accepted := false
+	for _, item := range strings.Split(value, ",") {
+		coding, q := parseQuality(item)
+		switch strings.ToLower(coding) {
+		case "gzip", "x-gzip":
+			// An explicit gzip overrides "*"
+			return q > 0
+		case "*":
+			accepted = q > 0
+		}
+	}
+	return accepted
+}
+
+// prefersJSON reports whether an Accept value ranks application/json above
+// text/html
+func prefersJSON(value string) bool {
+	jsonQ, htmlQ := 0.0, 0.0
+	for _, item := range strings.Split(value, ",") {
+		mediaType, q := parseQuality(item)
+		switch strings.ToLower(mediaType) {
+		case "application/json":
+			jsonQ = q
+		case "text/html":
+			htmlQ = q
+		}
+	}
+	return jsonQ > htmlQ
+}
+
+// parseQuality splits a list element like "gzip;q=0.5" into its value and
+// quality, 1 if not given and 0 if malformed
+func parseQuality(item string) (string, float64) {
+	value, params, _ := strings.Cut(item, ";")
+	q := 1.0
+	for _, param := range strings.Split(params, ";") {
+		name, v, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if !ok || !strings.EqualFold(strings.TrimSpace(name), "q") {
+			continue
+		}
+		parsed, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil || parsed < 0 || parsed > 1 {
+			parsed = 0
+		}
+		q = parsed
+	}
+	return strings.TrimSpace(value), q
+}
@@ -0,0 +1,233 @@
+package fileserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serve runs handler for the raw request head and returns the response
+func serve(t *testing.T, head string, handler func(w *response.ResponseWriter, req *request.Request)) string {
+	req, err := request.RequestFromReader(strings.NewReader(head + "\r\n"))
+	require.NoError(t, err)
+	out := &bytes.Buffer{}
+	w := response.NewWriter(out)
+	w.SetDefaults(response.Defaults{OmitDate: true})
+	w.SetDiscardBody(req.RequestLine.Method == "HEAD")
+	rw := response.NewResponseWriter(w)
+	handler(rw, req)
+	require.NoError(t, rw.Finish())
+	return out.String()
+}
+
+func TestParseRange(t *testing.T) {
+	// Test: Single, open-ended, suffix and clamped ranges
+	ranges, err := parseRange("bytes=0-4", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []byteRange{{0, 5}}, ranges)
+	ranges, err = parseRange("bytes=7-", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []byteRange{{7, 3}}, ranges)
+	ranges, err = parseRange("bytes=-3", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []byteRange{{7, 3}}, ranges)
+	ranges, err = parseRange("bytes=-30", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []byteRange{{0, 10}}, ranges)
+	ranges, err = parseRange("bytes=8-20", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []byteRange{{8, 2}}, ranges)
+
+	// Test: Several ranges, the unsatisfiable one skipped
+	ranges, err = parseRange("bytes=0-1, 4-5 ,20-30", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []byteRange{{0, 2}, {4, 2}}, ranges)
+
+	// Test: Nothing satisfiable
+	_, err = parseRange("bytes=10-", 10)
+	require.ErrorIs(t, err, errUnsatisfiable)
+	_, err = parseRange("bytes=-0", 10)
+	require.ErrorIs(t, err, errUnsatisfiable)
+
+	// Test: Headers to ignore
+	for _, value := range []string{"items=0-1", "bytes=", "bytes=5-2", "bytes=a-b", "bytes=+1-2", "bytes=1", "bytes=0-9,0-9"} {
+		ranges, err = parseRange(value, 10)
+		require.NoError(t, err, value)
+		assert.Nil(t, ranges, value)
+	}
+}
+
+func TestServeContent(t *testing.T) {
+	const content = "0123456789"
+	modtime := time.Date(2024, 5, 1, 12, 0, 0, 500, time.UTC)
+	handler := func(w *response.ResponseWriter, req *request.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("ETag", `"v1"`)
+		ServeContent(w, req, modtime, strings.NewReader(content))
+	}
+
+	// Test: Whole content
+	out := serve(t, "GET /f HTTP/1.1\r\nHost: x\r\n", handler)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, out, "Accept-Ranges: bytes\r\n")
+	assert.Contains(t, out, "Last-Modified: Wed, 01 May 2024 12:00:00 GMT\r\n")
+	assert.Contains(t, out, "Content-Length: 10\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n"+content))
+
+	// Test: Single range
+	out = serve(t, "GET /f HTTP/1.1\r\nHost: x\r\nRange: bytes=2-5\r\n", handler)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 206 Partial Content\r\n"))
+	assert.Contains(t, out, "Content-Range: bytes 2-5/10\r\n")
+	assert.Contains(t, out, "Content-Length: 4\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n2345"))
+
+	// Test: Multiple ranges as multipart/byteranges
+	out = serve(t, "GET /f HTTP/1.1\r\nHost: x\r\nRange: bytes=0-1,-2\r\n", handler)
+	head, body, ok := strings.Cut(out, "\r\n\r\n")
+	require.True(t, ok)
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 206 Partial Content\r\n"))
+	_, boundary, ok := strings.Cut(head, "Content-Type: multipart/byteranges; boundary=")
+	require.True(t, ok)
+	boundary, _, _ = strings.Cut(boundary, "\r\n")
+	assert.Contains(t, head, "Content-Length: "+strconv.Itoa(len(body))+"\r\n")
+	mr := request.NewMultipartReader(strings.NewReader(body), boundary)
+	var parts []string
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		data := &bytes.Buffer{}
+		data.ReadFrom(part)
+		contentRange, _ := part.Headers.Get("Content-Range")
+		contentType, _ := part.Headers.Get("Content-Type")
+		parts = append(parts, contentType+"|"+contentRange+"|"+data.String())
+	}
+	assert.Equal(t, []string{"text/plain|bytes 0-1/10|01", "text/plain|bytes 8-9/10|89"}, parts)
+
+	// Test: Unsatisfiable range
+	out = serve(t, "GET /f HTTP/1.1\r\nHost: x\r\nRange: bytes=10-\r\n", handler)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 416 Range Not Satisfiable\r\n"))
+	assert.Contains(t, out, "Content-Range: bytes */10\r\n")
+
+	// Test: If-Range with a matching ETag or date applies the range
+	out = serve(t, "GET /f HTTP/1.1\r\nHost: x\r\nRange: bytes=0-0\r\nIf-Range: \"v1\"\r\n", handler)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 206 Partial Content\r\n"))
+	out = serve(t, "GET /f HTTP/1.1\r\nHost: x\r\nRange: bytes=0-0\r\nIf-Range: Wed, 01 May 2024 12:00:00 GMT\r\n", handler)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 206 Partial Content\r\n"))
+
+	// Test: A stale or weak If-Range gets the whole content
+	for _, ifRange := range []string{`"v0"`, `W/"v1"`, "Wed, 01 May 2024 11:00:00 GMT"} {
+		out = serve(t, "GET /f HTTP/1.1\r\nHost: x\r\nRange: bytes=0-0\r\nIf-Range: "+ifRange+"\r\n", handler)
+		assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"), ifRange)
+	}
+
+	// Test: HEAD gets the headers of the range only
+	out = serve(t, "HEAD /f HTTP/1.1\r\nHost: x\r\nRange: bytes=2-5\r\n", handler)
+	assert.Contains(t, out, "Content-Length: 4\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n"))
+
+	// Test: Range is ignored for other methods
+	out = serve(t, "POST /f HTTP/1.1\r\nHost: x\r\nRange: bytes=2-5\r\n", handler)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+}
+
+func TestDetectContentType(t *testing.T) {
+	assert.Equal(t, "image/png", detectContentType([]byte("\x89PNG\r\n\x1a\n....")))
+	assert.Equal(t, "video/mp4", detectContentType([]byte("\x00\x00\x00\x20ftypisom")))
+	assert.Equal(t, "text/html; charset=utf-8", detectContentType([]byte("\n  <!DOCTYPE html><p>hi")))
+	assert.Equal(t, "text/plain; charset=utf-8", detectContentType([]byte("héllo\n")))
+	// A rune cut off at the end is still text
+	assert.Equal(t, "text/plain; charset=utf-8", detectContentType([]byte("h\xc3")))
+	assert.Equal(t, "application/octet-stream", detectContentType([]byte("\x00\x01\x02")))
+}
+
+func TestFileServer(t *testing.T) {
+	modtime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	fsys := fstest.MapFS{
+		"index.html":         {Data: []byte("<h1>home</h1>"), ModTime: modtime},
+		"notes":              {Data: []byte("plain notes"), ModTime: modtime},
+		"app.js":             {Data: []byte("console.log(1)"), ModTime: modtime},
+		"app.js.gz":          {Data: []byte("\x1f\x8b\x08gzipped"), ModTime: modtime},
+		"docs/a b.txt":       {Data: []byte("a"), ModTime: modtime},
+		"docs/sub/index.htm": {Data: []byte("x"), ModTime: modtime},
+	}
+	fileServer := New(fsys, Options{Prefix: "/static/", Listing: true})
+	get := func(target, extra string) string {
+		return serve(t, "GET "+target+" HTTP/1.1\r\nHost: x\r\n"+extra, fileServer.ServeHTTP)
+	}
+
+	// Test: index.html for the root
+	out := get("/static/", "")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, out, "Content-Type: text/html; charset=utf-8\r\n")
+	assert.Contains(t, out, "Last-Modified: Wed, 01 May 2024 12:00:00 GMT\r\n")
+	assert.True(t, strings.HasSuffix(out, "<h1>home</h1>"))
+
+	// Test: Type by extension and by sniffing
+	out = get("/static/app.js", "")
+	assert.Contains(t, out, "Content-Type: text/javascript; charset=utf-8\r\n")
+	assert.Contains(t, out, "Vary: Accept-Encoding\r\n")
+	assert.NotContains(t, out, "Content-Encoding")
+	out = get("/static/notes", "")
+	assert.Contains(t, out, "Content-Type: text/plain; charset=utf-8\r\n")
+
+	// Test: Precompressed sibling for clients accepting gzip
+	out = get("/static/app.js", "Accept-Encoding: br, gzip;q=0.8\r\n")
+	assert.Contains(t, out, "Content-Encoding: gzip\r\n")
+	assert.Contains(t, out, "Content-Type: text/javascript; charset=utf-8\r\n")
+	assert.True(t, strings.HasSuffix(out, "\x1f\x8b\x08gzipped"))
+	out = get("/static/app.js", "Accept-Encoding: *, gzip;q=0\r\n")
+	assert.NotContains(t, out, "Content-Encoding")
+
+	// Test: Directories need the trailing slash
+	out = get("/static/docs?sort=name", "")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 301 Moved Permanently\r\n"))
+	assert.Contains(t, out, "Location: ./docs/?sort=name\r\n")
+	out = get("/static", "")
+	assert.Contains(t, out, "Location: ./static/\r\n")
+	out = get("/static/notes/", "")
+	assert.Contains(t, out, "Location: ../notes\r\n")
+
+	// Test: HTML and JSON listings
+	out = get("/static/docs/", "")
+	assert.Contains(t, out, "<title>Index of /static/docs/</title>")
+	assert.Contains(t, out, `<a href="../">../</a>`)
+	assert.Contains(t, out, `<a href="./a%20b.txt">a b.txt</a>`)
+	assert.Contains(t, out, `<a href="./sub/">sub/</a>`)
+	out = get("/static/docs/", "Accept: application/json\r\n")
+	assert.Contains(t, out, "Content-Type: application/json\r\n")
+	_, body, _ := strings.Cut(out, "\r\n\r\n")
+	var entries []Entry
+	require.NoError(t, json.Unmarshal([]byte(body), &entries))
+	require.Len(t, entries, 2)
+	assert.Equal(t, Entry{Name: "a b.txt", URL: "./a%20b.txt", Size: 1, Modified: modtime}, entries[0])
+	assert.True(t, entries[1].Dir)
+
+	// Test: No listing without the option
+	out = serve(t, "GET /static/docs/ HTTP/1.1\r\nHost: x\r\n", New(fsys, Options{Prefix: "/static"}).ServeHTTP)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 403 Forbidden\r\n"))
+
+	// Test: Missing files, paths outside the prefix and traversal
+	for _, target := range []string{"/static/missing", "/other/notes", "/static/../../etc/passwd", "/static/%2e%2e/%2e%2e/etc/passwd"} {
+		out = get(target, "")
+		assert.True(t, strings.HasPrefix(out, "HTTP/1.1 404 Not Found\r\n"), target)
+	}
+
+	// Test: Only GET and HEAD
+	out = serve(t, "POST /static/notes HTTP/1.1\r\nHost: x\r\n", fileServer.ServeHTTP)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 405 Method Not Allowed\r\n"))
+	assert.Contains(t, out, "Allow: GET, HEAD\r\n")
+	out = serve(t, "HEAD /static/notes HTTP/1.1\r\nHost: x\r\n", fileServer.ServeHTTP)
+	assert.Contains(t, out, "Content-Length: 11\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n"))
+}
@@ -0,0 +1,97 @@
+package fileserver
+
+import (
+	"bytes"
+	"unicode/utf8"
+)
+
+// sniffLen is how much of the content detectContentType looks at
+const sniffLen = 512
+
+// signature is a prefix identifying a content type. Bytes where mask is 0
+// are ignored, a nil mask compares every byte.
+type signature struct {
+	prefix      []byte
+	mask        []byte
+	contentType string
+}
+
+var signatures = []signature{
+	{prefix: []byte("%PDF-"), contentType: "application/pdf"},
+	{prefix: []byte("\x89PNG\r\n\x1a\n"), contentType: "image/png"},
+	{prefix: []byte("\xff\xd8\xff"), contentType: "image/jpeg"},
+	{prefix: []byte("GIF87a"), contentType: "image/gif"},
+	{prefix: []byte("GIF89a"), contentType: "image/gif"},
+	{prefix: []byte("RIFF\x00\x00\x00\x00WEBPVP"), mask: []byte("\xff\xff\xff\xff\x00\x00\x00\x00\xff\xff\xff\xff\xff\xff"), contentType: "image/webp"},
+	{prefix: []byte("\x00\x00\x00\x00ftyp"), mask: []byte("\x00\x00\x00\x00\xff\xff\xff\xff"), contentType: "video/mp4"},
+	{prefix: []byte("\x1a\x45\xdf\xa3"), contentType: "video/webm"},
+	{prefix: []byte("OggS\x00"), contentType: "application/ogg"},
+	{prefix: []byte("ID3"), contentType: "audio/mpeg"},
+	{prefix: []byte("wOFF"), contentType: "font/woff"},
+	{prefix: []byte("wOF2"), contentType: "font/woff2"},
+	{prefix: []byte("\x00asm"), contentType: "application/wasm"},
+	{prefix: []byte("PK\x03\x04"), contentType: "application/zip"},
+	{prefix: []byte("\x1f\x8b\x08"), contentType: "application/gzip"},
+}
+
+// htmlPrefixes start an HTML document, compared case-insensitively after
+// leading whitespace
+var htmlPrefixes = []string{"<!doctype html", "<html", "<head", "<body", "<!--"}
+
+// detectContentType guesses the content type from the first bytes of the
+// content: known binary signatures, then HTML, then plain text if it's UTF-8
+// without control characters, and application/octet-stream otherwise.
+func detectContentType(data []byte) string {
+	if len(data) > sniffLen {
+		data = data[:sniffLen]
+	}
+	for _, sig := range signatures {
+		if sig.matches(data) {
+			return sig.contentType
+		}
+	}
+
+	trimmed := bytes.TrimLeft(data, "\t\n\x0c\r ")
+	for _, prefix := range htmlPrefixes {
+		if len(trimmed) >= len(prefix) && bytes.EqualFold(trimmed[:len(prefix)], []byte(prefix)) {
+			return "text/html; charset=utf-8"
+		}
+	}
+	if isText(data) {
+		return "text/plain; charset=utf-8"
+	}
+	return "application/octet-stream"
+}
+
+func (sig signature) matches(data []byte) bool {
+	if len(data) < len(sig.prefix) {
+		return false
+	}
+	for i, b := range sig.prefix {
+		if sig.mask != nil {
+			b &= sig.mask[i]
+			if data[i]&sig.mask[i] != b {
+				return false
+			}
+		} else if data[i] != b {
+			return false
+		}
+	}
+	return true
+}
+
+// isText reports whether data looks like UTF-8 text. A rune cut off at the
+// end of data is allowed, as data may be the start of a longer content.
+func isText(data []byte) bool {
+	for len(data) > 0 {
+		r, size := utf8.DecodeRune(data)
+		if r == utf8.RuneError && size == 1 {
+			return len(data) < utf8.UTFMax && !utf8.FullRune(data)
+		}
+		if r < ' ' && r != '\t' && r != '\n' && r != '\r' && r != '\x0c' || r == 0x7f {
+			return false
+		}
+		data = data[size:]
+	}
+	return true
+}
@@ -1,25 +1,175 @@
 package headers
 
 import (
+	"bytes"
 	"fmt"
+	"httpfromtcp/internal/httperr"
+	"io"
+	"slices"
 	"strings"
 )
 
 const allowedFieldNameChars = "abcdefghijklmnopqrstuvwxyz0123456789!#$%&'*+-.^_`|~"
 
-type Headers map[string]string
+// Field is a single field line. Name keeps the casing it was received or
+// added with.
+type Field struct {
+	Name  string
+	Value string
+}
+
+// Headers holds field lines in the order they were received or added. Names
+// are compared case-insensitively and repeated names keep one line each, so
+// fields like Set-Cookie survive. The zero value is empty and ready to use,
+// and a nil *Headers reads as empty.
+type Headers struct {
+	fields []Field
+}
+
+func NewHeaders() *Headers {
+	return &Headers{}
+}
+
+// lines returns the field lines, none for a nil h
+func (h *Headers) lines() []Field {
+	if h == nil {
+		return nil
+	}
+	return h.fields
+}
 
-func NewHeaders() Headers {
-	return make(Headers)
+// Get returns the value of the first field named key
+func (h *Headers) Get(key string) (string, bool) {
+	for _, f := range h.lines() {
+		if strings.EqualFold(f.Name, key) {
+			return f.Value, true
+		}
+	}
+	return "", false
+}
+
+// Values returns the values of every field named key, in order
+func (h *Headers) Values(key string) []string {
+	var values []string
+	for _, f := range h.lines() {
+		if strings.EqualFold(f.Name, key) {
+			values = append(values, f.Value)
+		}
+	}
+	return values
 }
 
-func (h Headers) Get(key string) (string, bool) {
-	key = strings.ToLower(key)
-	value, ok := h[key]
-	return value, ok
+// Add appends a field line, keeping any existing fields named key
+func (h *Headers) Add(key, value string) {
+	h.fields = append(h.fields, Field{Name: key, Value: value})
 }
 
-func (h Headers) Parse(data []byte) (n int, done bool, err error) {
+// Set replaces the fields named key with a single one, in place of the first
+// of them, or appends it if there were none
+func (h *Headers) Set(key, value string) {
+	for i, f := range h.fields {
+		if strings.EqualFold(f.Name, key) {
+			h.fields[i] = Field{Name: key, Value: value}
+			h.del(key, i+1)
+			return
+		}
+	}
+	h.Add(key, value)
+}
+
+// Del removes every field named key
+func (h *Headers) Del(key string) {
+	h.del(key, 0)
+}
+
+func (h *Headers) del(key string, from int) {
+	kept := h.fields[:from]
+	for _, f := range h.fields[from:] {
+		if !strings.EqualFold(f.Name, key) {
+			kept = append(kept, f)
+		}
+	}
+	clear(h.fields[len(kept):])
+	h.fields = kept
+}
+
+// Clone returns a copy of h that can be changed independently
+func (h *Headers) Clone() *Headers {
+	return &Headers{fields: slices.Clone(h.lines())}
+}
+
+// Len returns the number of field lines
+func (h *Headers) Len() int {
+	return len(h.lines())
+}
+
+// Fields returns the field lines in order. The slice must not be modified.
+func (h *Headers) Fields() []Field {
+	return h.lines()
+}
+
+// HasToken reports whether the comma-separated values of the key fields
+// contain token, compared case-insensitively (e.g. "Connection: close")
+func (h *Headers) HasToken(key, token string) bool {
+	for _, value := range h.Values(key) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Write writes the field lines in order as "Name: value\r\n", without the
+// empty line ending the section. Names must be tokens and values must not
+// contain control characters, so a field can't inject another line.
+func (h *Headers) Write(w io.Writer) error {
+	var buf bytes.Buffer
+	for _, f := range h.lines() {
+		if !validFieldName(f.Name) {
+			return fmt.Errorf("invalid field name %q", f.Name)
+		}
+		value := strings.Trim(f.Value, " \t")
+		if i := invalidValueChar(value); i != -1 {
+			return fmt.Errorf("invalid character %q in value of %s", value[i], f.Name)
+		}
+		buf.WriteString(f.Name)
+		buf.WriteString(": ")
+		buf.WriteString(value)
+		buf.WriteString("\r\n")
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func validFieldName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, char := range strings.ToLower(name) {
+		if !strings.ContainsRune(allowedFieldNameChars, char) {
+			return false
+		}
+	}
+	return true
+}
+
+// invalidValueChar returns the index of the first control character other
+// than horizontal tab in value, or -1
+func invalidValueChar(value string) int {
+	for i := 0; i < len(value); i++ {
+		if value[i] < ' ' && value[i] != '\t' || value[i] == 0x7f {
+			return i
+		}
+	}
+	return -1
+}
+
+// Parse parses one field line from data. It returns done when data starts with
+// the empty line ending the field section. Errors are *httperr.ParseError with
+// offsets relative to the start of data.
+func (h *Headers) Parse(data []byte) (n int, done bool, err error) {
 	bytesConsumed := 0
 	fieldLine := string(data)
 
@@ -28,61 +178,54 @@ func (h Headers) Parse(data []byte) (n int, done bool, err error) {
 		return 2, true, nil
 	}
 
-	CRLFCount := strings.Count(fieldLine, "\r\n")
-	//check if request has at least "\r\n" in it and trim accordingly
-	if CRLFCount == 2 {
-		parts := strings.Split(fieldLine, "\r\n\r\n")
-		fieldLine = parts[0]
-	} else if CRLFCount >= 1 { //store the first field-line and throw the rest
-		parts := strings.Split(fieldLine, "\r\n")
-		fieldLine = parts[0]
-	} else {
+	//check if request has at least "\r\n" in it and store the first field-line, the rest is parsed by the next call
+	lineEnd := strings.Index(fieldLine, "\r\n")
+	if lineEnd == -1 {
 		return bytesConsumed, false, nil
 	}
+	fieldLine = fieldLine[:lineEnd]
 
 	// Split the header line into key and value
 	parts := strings.SplitN(fieldLine, ":", 2)
 	if len(parts) != 2 {
-		return bytesConsumed, false, fmt.Errorf("invalid field line, illegal colon count: %q", fieldLine)
+		return bytesConsumed, false, httperr.New(httperr.KindMalformedFieldLine, 0, "missing colon: %q", fieldLine)
 	}
+	colon := len(parts[0])
 
 	// Check if parts[0] has space before ":"
 	if strings.HasSuffix(parts[0], " ") {
-		return bytesConsumed, false, fmt.Errorf("invalid field line, space before colon: %q", fieldLine)
+		return bytesConsumed, false, httperr.New(httperr.KindBadFieldName, colon-1, "space before colon: %q", fieldLine)
 	}
 
 	// Trim whitespace from key and value
+	keyStart := len(parts[0]) - len(strings.TrimLeft(parts[0], " \t"))
 	key := strings.TrimSpace(parts[0])
 	value := strings.TrimSpace(parts[1])
-	if key == "" || value == "" {
-		return bytesConsumed, false, fmt.Errorf("invalid field line, empty field-name or field-value: %q", fieldLine)
+	if key == "" {
+		return bytesConsumed, false, httperr.New(httperr.KindBadFieldName, keyStart, "empty field-name: %q", fieldLine)
+	}
+	if value == "" {
+		return bytesConsumed, false, httperr.New(httperr.KindBadFieldValue, colon+1, "empty field-value: %q", fieldLine)
 	}
-
-	// Before storing convert key to lower-case
-	key = strings.ToLower(key)
 
 	// Check if key contains only allowed characters using a lookup string
-	for _, char := range key {
+	for i, char := range strings.ToLower(key) {
 		if !strings.ContainsRune(allowedFieldNameChars, char) {
-			return bytesConsumed, false, fmt.Errorf("invalid field line, field-name contains illegal character: %q", fieldLine)
+			return bytesConsumed, false, httperr.New(httperr.KindBadFieldName, keyStart+i, "illegal character %q: %q", char, fieldLine)
 		}
 	}
 
-	// Store the header in the map
-	// Check if key is already present in the map and append the new value to the existing value, separated by a comma.
-	if existingValue, ok := h[key]; ok {
-		// Check if the existing value already equals the new value
-		if existingValue == value {
-			return bytesConsumed, false, fmt.Errorf("invalid field line, field-value already present: %q", fieldLine)
-		}
-		h[key] = existingValue + ", " + value
-	} else {
-		// If the key is not present, simply store the new value.
-		h[key] = value
+	// Control characters other than horizontal tab are not allowed in values
+	valueStart := strings.Index(fieldLine[colon+1:], value) + colon + 1
+	if i := invalidValueChar(value); i != -1 {
+		return bytesConsumed, false, httperr.New(httperr.KindBadFieldValue, valueStart+i, "illegal control character %q: %q", value[i], fieldLine)
 	}
 
-	// Calculate the number of bytes consumed
-	bytesConsumed = len(key) + len(value) + 4 // 4 for ": " and "\r\n"
+	// Store the field line as received, repeated names get a line each
+	h.Add(key, value)
+
+	// Calculate the number of bytes consumed, the raw line including any surrounding whitespace
+	bytesConsumed = len(fieldLine) + 2 // 2 for "\r\n"
 
 	//print h for debugging
 	//fmt.Println("Headers: ", h)
@@ -1,6 +1,7 @@
 package headers
 
 import (
+	"bytes"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -15,7 +16,7 @@ func TestRequestLineParse(t *testing.T) {
 	n, done, err := headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
+	assert.Equal(t, []string{"localhost:42069"}, headers.Values("host"))
 	assert.Equal(t, 23, n)
 	assert.False(t, done)
 
@@ -78,39 +79,39 @@ func TestRequestLineParse(t *testing.T) {
 
 	// Test: Valid header with multiple lines
 	headers = NewHeaders()
-	headers["host"] = "localhost:42069"
-	headers["user-Agent"] = "curl/7.81.0"
+	headers.Add("host", "localhost:42069")
+	headers.Add("user-Agent", "curl/7.81.0")
 	data = []byte("Accept: */*\r\n\r\n")
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
-	assert.Equal(t, "localhost:42069", headers["host"])
-	assert.Equal(t, "curl/7.81.0", headers["user-Agent"])
-	assert.Equal(t, "*/*", headers["accept"])
+	assert.Equal(t, []string{"localhost:42069"}, headers.Values("host"))
+	assert.Equal(t, []string{"curl/7.81.0"}, headers.Values("user-Agent"))
+	assert.Equal(t, []string{"*/*"}, headers.Values("accept"))
 	assert.Equal(t, 13, n)
 	assert.False(t, done)
 
 	// Test: Valid header with multiple lines and extra spaces
 	headers = NewHeaders()
-	headers["host"] = "localhost:42069"
-	headers["accept"] = "*/*"
+	headers.Add("host", "localhost:42069")
+	headers.Add("accept", "*/*")
 	data = []byte("       User-Agent:       curl/7.81.0\r\n")
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
-	assert.Equal(t, "localhost:42069", headers["host"])
-	assert.Equal(t, "curl/7.81.0", headers["user-agent"])
-	assert.Equal(t, "*/*", headers["accept"])
-	assert.Equal(t, 25, n)
+	assert.Equal(t, []string{"localhost:42069"}, headers.Values("host"))
+	assert.Equal(t, []string{"curl/7.81.0"}, headers.Values("user-agent"))
+	assert.Equal(t, []string{"*/*"}, headers.Values("accept"))
+	assert.Equal(t, 38, n)
 	assert.False(t, done)
 
 	// Test: Valid header with same keys diffrent case sensitivity
 	headers = NewHeaders()
-	headers["host"] = "localhost:42069"
-	headers["user-agent"] = "curl/7.81.0"
+	headers.Add("host", "localhost:42069")
+	headers.Add("user-agent", "curl/7.81.0")
 	data = []byte("hoSt: localhost:69420\r\n\r\n")
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
-	assert.Equal(t, "localhost:42069, localhost:69420", headers["host"])
-	assert.Equal(t, "curl/7.81.0", headers["user-agent"])
+	assert.Equal(t, []string{"localhost:42069", "localhost:69420"}, headers.Values("host"))
+	assert.Equal(t, []string{"curl/7.81.0"}, headers.Values("user-agent"))
 	assert.Equal(t, 23, n)
 	assert.False(t, done)
 
@@ -122,3 +123,70 @@ func TestRequestLineParse(t *testing.T) {
 	assert.Equal(t, 0, n)
 	assert.False(t, done)
 }
+
+func TestHeadersOrderAndCasing(t *testing.T) {
+	// Test: Field lines keep their order, casing and repeats
+	headers := NewHeaders()
+	data := []byte("Set-Cookie: a=1\r\nHOST: localhost\r\nset-cookie: a=1\r\n\r\n")
+	for {
+		n, done, err := headers.Parse(data)
+		require.NoError(t, err)
+		data = data[n:]
+		if done {
+			break
+		}
+	}
+	assert.Equal(t, []Field{
+		{Name: "Set-Cookie", Value: "a=1"},
+		{Name: "HOST", Value: "localhost"},
+		{Name: "set-cookie", Value: "a=1"},
+	}, headers.Fields())
+	assert.Equal(t, []string{"a=1", "a=1"}, headers.Values("SET-COOKIE"))
+	value, ok := headers.Get("host")
+	assert.True(t, ok)
+	assert.Equal(t, "localhost", value)
+
+	// Test: Set replaces every line in place of the first
+	clone := headers.Clone()
+	clone.Set("set-cookie", "b=2")
+	assert.Equal(t, []Field{
+		{Name: "set-cookie", Value: "b=2"},
+		{Name: "HOST", Value: "localhost"},
+	}, clone.Fields())
+	assert.Equal(t, 3, headers.Len())
+
+	// Test: Del removes every line
+	clone.Del("Set-Cookie")
+	_, ok = clone.Get("set-cookie")
+	assert.False(t, ok)
+	assert.Equal(t, 1, clone.Len())
+
+	// Test: Write serialises in order
+	var buf bytes.Buffer
+	headers.Add("Content-Type", "text/plain")
+	require.NoError(t, headers.Write(&buf))
+	assert.Equal(t, "Set-Cookie: a=1\r\nHOST: localhost\r\nset-cookie: a=1\r\nContent-Type: text/plain\r\n", buf.String())
+
+	// Test: Write refuses values that would inject a field line
+	headers = NewHeaders()
+	headers.Add("X-Bad", "a\r\nInjected: yes")
+	require.Error(t, headers.Write(&buf))
+	headers = NewHeaders()
+	headers.Add("X Bad", "a")
+	require.Error(t, headers.Write(&buf))
+
+	// Test: A nil Headers reads as empty
+	var none *Headers
+	_, ok = none.Get("Host")
+	assert.False(t, ok)
+	assert.Nil(t, none.Values("Host"))
+	assert.Empty(t, none.Fields())
+	assert.Equal(t, 0, none.Len())
+	assert.False(t, none.HasToken("Connection", "close"))
+	buf.Reset()
+	require.NoError(t, none.Write(&buf))
+	assert.Empty(t, buf.String())
+	clone = none.Clone()
+	clone.Set("Host", "localhost")
+	assert.Equal(t, 1, clone.Len())
+}
@@ -0,0 +1,99 @@
+package httperr
+
+import "fmt"
+
+// Kind is the category of a ParseError. A Kind is itself an error so callers
+// can test for a category with errors.Is(err, httperr.KindBadMethod).
+type Kind int
+
+const (
+	KindMalformedRequestLine Kind = iota + 1
+	KindBadMethod
+	KindBadTarget
+	KindBadVersion
+	KindUnsupportedVersion
+	KindRequestLineTooLong
+	KindMalformedFieldLine
+	KindBadFieldName
+	KindBadFieldValue
+	KindHeadersTooLarge
+	KindBodyTooLarge
+	KindBadContentLength
+	KindContentLengthMismatch
+	KindUnsupportedTransferEncoding
+	KindAmbiguousFraming
+	KindBadChunk
+	KindUnexpectedEOF
+)
+
+var kindNames = map[Kind]string{
+	KindMalformedRequestLine:        "malformed request line",
+	KindBadMethod:                   "bad method",
+	KindBadTarget:                   "bad request target",
+	KindBadVersion:                  "bad HTTP version",
+	KindUnsupportedVersion:          "unsupported HTTP version",
+	KindRequestLineTooLong:          "request line too long",
+	KindMalformedFieldLine:          "malformed field line",
+	KindBadFieldName:                "bad field name",
+	KindBadFieldValue:               "bad field value",
+	KindHeadersTooLarge:             "header fields too large",
+	KindBodyTooLarge:                "body too large",
+	KindBadContentLength:            "bad content-length",
+	KindContentLengthMismatch:       "body does not match content-length",
+	KindUnsupportedTransferEncoding: "unsupported transfer coding",
+	KindAmbiguousFraming:            "both content-length and transfer-encoding",
+	KindBadChunk:                    "malformed chunk",
+	KindUnexpectedEOF:               "unexpected end of stream",
+}
+
+func (k Kind) String() string {
+	if name, ok := kindNames[k]; ok {
+		return name
+	}
+	return fmt.Sprintf("kind(%d)", int(k))
+}
+
+func (k Kind) Error() string {
+	return k.String()
+}
+
+// ParseError reports a syntax or framing error in a request, with the byte
+// offset from the start of the request where it was found.
+type ParseError struct {
+	Kind   Kind
+	Offset int
+	Msg    string
+	Err    error // underlying error, if any
+}
+
+func New(kind Kind, offset int, format string, args ...any) *ParseError {
+	return &ParseError{Kind: kind, Offset: offset, Msg: fmt.Sprintf(format, args...)}
+}
+
+// Wrap is like New but keeps err as the underlying error
+func Wrap(kind Kind, offset int, err error, format string, args ...any) *ParseError {
+	pe := New(kind, offset, format, args...)
+	pe.Err = err
+	return pe
+}
+
+func (e *ParseError) Error() string {
+	msg := fmt.Sprintf("%s at byte %d", e.Kind, e.Offset)
+	if e.Msg != "" {
+		msg += ": " + e.Msg
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+// Is matches the Kind of the error, so errors.Is(err, KindBadMethod) works
+func (e *ParseError) Is(target error) bool {
+	kind, ok := target.(Kind)
+	return ok && kind == e.Kind
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
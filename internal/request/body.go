@@ -0,0 +1,228 @@
+package request
+
+import (
+	"errors"
+	"httpfromtcp/internal/httperr"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// NoBody is the Body of requests that have none. It is always at EOF.
+var NoBody = noBody{}
+
+type noBody struct{}
+
+func (noBody) Read([]byte) (int, error) { return 0, io.EOF }
+func (noBody) Close() error             { return nil }
+
+// ErrBodyReadAfterClose is returned when reading a body after closing it
+var ErrBodyReadAfterClose = errors.New("request: read on closed body")
+
+// body streams a request body off the connection, decoding chunked encoding.
+// It reads through the Reader's buffer so that bytes of the next request read
+// along with the end of the body are kept.
+type body struct {
+	rr        *Reader
+	r         *Request
+	chunked   bool
+	remaining int64 // bytes left of a content-length body
+	done      bool  // read to the end
+	err       error // sticky error, io.EOF once done
+	closed    bool
+}
+
+// setupBody works out how the body of r is delimited and sets r.Body
+func (rr *Reader) setupBody(r *Request) error {
+	rr.body = nil
+
+	// A body is delimited either by chunked encoding or by content-length
+	// Repeated field lines form a single comma-separated list
+	transferEncoding := strings.Join(r.Headers.Values("transfer-encoding"), ", ")
+	if transferEncoding != "" {
+		// HTTP/1.0 has no transfer codings, the framing can't be trusted
+		if !r.RequestLine.ProtoAtLeast(1, 1) {
+			return httperr.New(httperr.KindAmbiguousFraming, r.offset, "transfer-encoding in an HTTP/1.0 request")
+		}
+		if _, ok := r.Headers.Get("content-length"); ok {
+			return httperr.New(httperr.KindAmbiguousFraming, r.offset, "both transfer-encoding and content-length present")
+		}
+		// Only plain chunked is supported, other codings would need decoding
+		if !strings.EqualFold(strings.TrimSpace(transferEncoding), "chunked") {
+			return httperr.New(httperr.KindUnsupportedTransferEncoding, r.offset, "%q", transferEncoding)
+		}
+		r.state = requestStateParsingChunkSize
+		r.ContentLength = -1
+		rr.body = &body{rr: rr, r: r, chunked: true}
+		r.Body = rr.body
+		return nil
+	}
+
+	// Check if there is "contect-length" header
+	contentLengths := r.Headers.Values("content-length")
+	if len(contentLengths) == 0 {
+		// If there is no content length, the request has no body
+		r.state = requestStateDone
+		return nil
+	}
+	// Repeats are only tolerated if they agree
+	contentLengthStr := contentLengths[0]
+	for _, other := range contentLengths[1:] {
+		if other != contentLengthStr {
+			return httperr.New(httperr.KindBadContentLength, r.offset, "conflicting values %q and %q", contentLengthStr, other)
+		}
+	}
+	// Only digits are allowed, ParseInt would also take a sign
+	if contentLengthStr == "" || strings.Trim(contentLengthStr, "0123456789") != "" {
+		return httperr.New(httperr.KindBadContentLength, r.offset, "%q", contentLengthStr)
+	}
+	contentLength, err := strconv.ParseInt(contentLengthStr, 10, 64)
+	if err != nil {
+		return httperr.Wrap(httperr.KindBadContentLength, r.offset, err, "%q", contentLengthStr)
+	}
+	r.ContentLength = contentLength
+	if err := r.checkBodySize(contentLength); err != nil {
+		return err
+	}
+	if contentLength == 0 {
+		r.state = requestStateDone
+		return nil
+	}
+	rr.body = &body{rr: rr, r: r, remaining: contentLength}
+	r.Body = rr.body
+	return nil
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	if b.closed {
+		return 0, ErrBodyReadAfterClose
+	}
+	return b.read(p)
+}
+
+// Close marks the body as closed. It does not read the rest of the body, the
+// server discards it with FinishBody once the handler returns.
+func (b *body) Close() error {
+	b.closed = true
+	return nil
+}
+
+func (b *body) read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	var n int
+	var err error
+	if b.chunked {
+		n, err = b.readChunked(p)
+	} else {
+		n, err = b.readFixed(p)
+	}
+	if err != nil {
+		b.err = err
+		b.done = err == io.EOF
+	}
+	return n, err
+}
+
+// readFixed reads from a body delimited by content-length. The last bytes
+// are returned together with io.EOF.
+func (b *body) readFixed(p []byte) (int, error) {
+	if err := b.rr.fillBody(b.r); err != nil {
+		return 0, err
+	}
+	n := copy(p, b.rr.buf[:min(int64(b.rr.readToIndex), b.remaining)])
+	b.rr.consume(n)
+	b.r.offset += n
+	b.remaining -= int64(n)
+	if b.remaining == 0 {
+		b.r.state = requestStateDone
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// readChunked reads chunk data, parsing the chunk framing and the trailer
+// section around it
+func (b *body) readChunked(p []byte) (int, error) {
+	for {
+		if b.r.state == requestStateDone {
+			return 0, io.EOF
+		}
+		if b.r.state == requestStateParsingChunkData && b.r.chunkRemaining > 0 {
+			if err := b.rr.fillBody(b.r); err != nil {
+				return 0, err
+			}
+			n := copy(p, b.rr.buf[:min(int64(b.rr.readToIndex), b.r.chunkRemaining)])
+			b.rr.consume(n)
+			b.r.offset += n
+			b.r.chunkRemaining -= int64(n)
+			return n, nil
+		}
+
+		// Chunk size line, CRLF after chunk data or trailer fields
+		n, err := b.r.parseChunked(b.rr.buf[:b.rr.readToIndex])
+		if err != nil {
+			return 0, err
+		}
+		b.rr.consume(n)
+		b.r.offset += n
+		if n == 0 && b.r.state != requestStateDone {
+			// Not enough buffered to make progress
+			if b.rr.err != nil {
+				return 0, b.rr.unexpectedEnd(b.r)
+			}
+			b.rr.fill()
+		}
+	}
+}
+
+// fillBody makes sure at least one byte is buffered
+func (rr *Reader) fillBody(r *Request) error {
+	for rr.readToIndex == 0 {
+		if rr.err != nil {
+			return rr.unexpectedEnd(r)
+		}
+		rr.fill()
+	}
+	return nil
+}
+
+// CanDiscardBody reports whether what is left of the current request body is
+// known to fit in limit bytes, so that FinishBody(limit) can reach the next
+// request. The rest of a chunked body is unknown until it is read.
+func (rr *Reader) CanDiscardBody(limit int64) bool {
+	b := rr.body
+	if b == nil || b.done {
+		return true
+	}
+	return !b.chunked && b.remaining <= limit
+}
+
+// FinishBody reads and discards what is left of the current request body, up
+// to limit bytes, so the next request can be read. A non-nil error means the
+// body could not be read to the end and the connection can't be reused.
+func (rr *Reader) FinishBody(limit int64) error {
+	b := rr.body
+	if b == nil || b.done {
+		return nil
+	}
+	buf := make([]byte, bufferSize)
+	var discarded int64
+	for {
+		n, err := b.read(buf)
+		discarded += int64(n)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if discarded > limit {
+			return errors.New("request: too much unread body to discard")
+		}
+	}
+}
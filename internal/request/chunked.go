@@ -0,0 +1,107 @@
+package request
+
+import (
+	"bytes"
+	"httpfromtcp/internal/httperr"
+	"strconv"
+	"strings"
+)
+
+// Longest chunk size accepted, in hex digits, so the size fits in an int64
+const maxChunkSizeDigits = 15
+
+// parseChunkSize parses a chunk-size line, e.g. "1a;name=value\r\n". It
+// returns n == 0 if the line is not complete yet. Chunk extensions are
+// checked for illegal characters and otherwise ignored.
+func parseChunkSize(data []byte, maxLineBytes int) (size int64, n int, err error) {
+	lineEnd := bytes.Index(data, []byte("\r\n"))
+	if lineEnd == -1 {
+		if maxLineBytes > 0 && len(data) > maxLineBytes+2 {
+			return 0, 0, httperr.New(httperr.KindBadChunk, 0, "chunk-size line longer than %d bytes", maxLineBytes)
+		}
+		return 0, 0, nil
+	}
+	line := data[:lineEnd]
+
+	sizeEnd := bytes.IndexAny(line, "; \t")
+	if sizeEnd == -1 {
+		sizeEnd = len(line)
+	}
+	hex := string(line[:sizeEnd])
+	if hex == "" || len(hex) > maxChunkSizeDigits {
+		return 0, 0, httperr.New(httperr.KindBadChunk, 0, "invalid chunk-size %q", hex)
+	}
+	// Only hex digits are allowed, ParseInt would also take a sign
+	if strings.Trim(hex, "0123456789abcdefABCDEF") != "" {
+		return 0, 0, httperr.New(httperr.KindBadChunk, 0, "invalid chunk-size %q", hex)
+	}
+	size, err = strconv.ParseInt(hex, 16, 64)
+	if err != nil {
+		return 0, 0, httperr.Wrap(httperr.KindBadChunk, 0, err, "invalid chunk-size %q", hex)
+	}
+	// The size may only be followed by whitespace and chunk extensions
+	if rest := bytes.TrimLeft(line[sizeEnd:], " \t"); len(rest) > 0 && rest[0] != ';' {
+		return 0, 0, httperr.New(httperr.KindBadChunk, sizeEnd, "unexpected data after chunk-size %q", hex)
+	}
+
+	for i := sizeEnd; i < len(line); i++ {
+		if line[i] < ' ' && line[i] != '\t' || line[i] == 0x7f {
+			return 0, 0, httperr.New(httperr.KindBadChunk, i, "illegal character %q in chunk extension", line[i])
+		}
+	}
+	return size, lineEnd + 2, nil // +2 for "\r\n"
+}
+
+// parseChunked parses the framing of a chunked body: chunk-size lines, the
+// CRLF ending each chunk and the trailer fields, stored in r.Trailers. The
+// chunk data itself is left to the body reader.
+func (r *Request) parseChunked(data []byte) (int, error) {
+	switch r.state {
+	case requestStateParsingChunkSize:
+		size, n, err := parseChunkSize(data, r.limits.MaxHeaderLineBytes)
+		if err != nil {
+			return 0, offsetBy(err, r.offset)
+		}
+		if n == 0 {
+			return 0, nil
+		}
+		// Reject an oversized chunk before any of it is read
+		r.bodyBytes += size
+		if err := r.checkBodySize(r.bodyBytes); err != nil {
+			return 0, err
+		}
+		r.chunkRemaining = size
+		r.state = requestStateParsingChunkData
+		if size == 0 {
+			// The last chunk is followed by the trailer section
+			r.state = requestStateParsingTrailers
+		}
+		return n, nil
+	case requestStateParsingChunkData:
+		if r.chunkRemaining > 0 {
+			return 0, nil
+		}
+		// Every chunk ends with a CRLF of its own
+		if len(data) < 2 {
+			return 0, nil
+		}
+		if data[0] != '\r' || data[1] != '\n' {
+			return 0, httperr.New(httperr.KindBadChunk, r.offset, "chunk data not followed by CRLF")
+		}
+		r.state = requestStateParsingChunkSize
+		return 2, nil
+	case requestStateParsingTrailers:
+		n, done, err := r.Trailers.Parse(data)
+		if err != nil {
+			return n, offsetBy(err, r.offset)
+		}
+		if err := r.checkFieldLine(data, n, done); err != nil {
+			return n, err
+		}
+		if done {
+			r.state = requestStateDone
+		}
+		return n, nil
+	}
+	return 0, nil
+}
@@ -0,0 +1,201 @@
+package request
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"io"
+	"mime"
+	"os"
+)
+
+const (
+	maxFormBytes     = 10 * 1024 * 1024 // urlencoded body, or all multipart values together
+	defaultMaxMemory = 32 * 1024 * 1024 // files kept in memory by FormValue
+)
+
+var ErrNotForm = errors.New("request: content-type is not application/x-www-form-urlencoded")
+
+// MultipartForm is a parsed multipart/form-data body
+type MultipartForm struct {
+	Value map[string][]string
+	File  map[string][]*FileHeader
+}
+
+// FileHeader describes an uploaded file. Its content is kept in memory or,
+// past the memory threshold, in a temporary file.
+type FileHeader struct {
+	Filename string
+	Headers  *headers.Headers
+	Size     int64
+	content  []byte
+	tmpfile  string
+}
+
+// File is the content of an uploaded file
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+	io.Closer
+}
+
+// ParseForm reads an application/x-www-form-urlencoded body into r.Form. The
+// body is limited to maxFormBytes. Calling it again does nothing.
+func (r *Request) ParseForm() error {
+	if r.Form != nil {
+		return nil
+	}
+	contentType, _ := r.Headers.Get("Content-Type")
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != "application/x-www-form-urlencoded" {
+		return ErrNotForm
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxFormBytes+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > maxFormBytes {
+		return fmt.Errorf("request: form body longer than %d bytes", maxFormBytes)
+	}
+	form, err := parseQuery(string(body))
+	if err != nil {
+		return fmt.Errorf("request: malformed form body: %w", err)
+	}
+	r.Form = form
+	return nil
+}
+
+// ParseMultipartForm reads a multipart/form-data body into r.MultipartForm,
+// with the values also in r.Form. Files are kept in memory up to maxMemory
+// bytes in total, larger ones are written to temporary files, removed by
+// MultipartForm.RemoveAll. Calling it again does nothing.
+func (r *Request) ParseMultipartForm(maxMemory int64) error {
+	if r.MultipartForm != nil {
+		return nil
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return err
+	}
+
+	form := &MultipartForm{Value: map[string][]string{}, File: map[string][]*FileHeader{}}
+	valueBytes := int64(0)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			form.RemoveAll()
+			return err
+		}
+
+		if part.FileName == "" {
+			// A plain value, limited like a urlencoded form
+			value, err := io.ReadAll(io.LimitReader(part, maxFormBytes-valueBytes+1))
+			if err != nil {
+				form.RemoveAll()
+				return err
+			}
+			valueBytes += int64(len(value))
+			if valueBytes > maxFormBytes {
+				form.RemoveAll()
+				return fmt.Errorf("request: form values longer than %d bytes", maxFormBytes)
+			}
+			form.Value[part.Name] = append(form.Value[part.Name], string(value))
+			continue
+		}
+
+		fh, err := readFile(part, &maxMemory)
+		if err != nil {
+			form.RemoveAll()
+			return err
+		}
+		form.File[part.Name] = append(form.File[part.Name], fh)
+	}
+
+	r.MultipartForm = form
+	r.Form = Query(form.Value)
+	return nil
+}
+
+// readFile reads the content of a file part, in memory while it fits in
+// *maxMemory and to a temporary file otherwise
+func readFile(part *Part, maxMemory *int64) (*FileHeader, error) {
+	fh := &FileHeader{Filename: part.FileName, Headers: part.Headers}
+
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, part, *maxMemory+1)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if n <= *maxMemory {
+		*maxMemory -= n
+		fh.content = buf.Bytes()
+		fh.Size = n
+		return fh, nil
+	}
+
+	// Too big for memory, spill what was read and the rest to disk
+	file, err := os.CreateTemp("", "multipart-")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	fh.tmpfile = file.Name()
+	size, err := io.Copy(file, io.MultiReader(&buf, part))
+	if err != nil {
+		os.Remove(fh.tmpfile)
+		return nil, err
+	}
+	fh.Size = size
+	return fh, nil
+}
+
+// Open opens the content of the file
+func (fh *FileHeader) Open() (File, error) {
+	if fh.tmpfile != "" {
+		return os.Open(fh.tmpfile)
+	}
+	return sectionReadCloser{io.NewSectionReader(bytes.NewReader(fh.content), 0, int64(len(fh.content)))}, nil
+}
+
+type sectionReadCloser struct {
+	*io.SectionReader
+}
+
+func (sectionReadCloser) Close() error {
+	return nil
+}
+
+// RemoveAll removes the temporary files of the form
+func (f *MultipartForm) RemoveAll() error {
+	var errs []error
+	for _, files := range f.File {
+		for _, fh := range files {
+			if fh.tmpfile != "" {
+				if err := os.Remove(fh.tmpfile); err != nil && !errors.Is(err, os.ErrNotExist) {
+					errs = append(errs, err)
+				}
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// FormValue returns the first value of key in the form body, parsing it if
+// needed, or else in the query. Parse errors are ignored.
+func (r *Request) FormValue(key string) string {
+	if r.Form == nil {
+		if r.ParseForm() == ErrNotForm {
+			r.ParseMultipartForm(defaultMaxMemory)
+		}
+	}
+	if values := r.Form[key]; len(values) > 0 {
+		return values[0]
+	}
+	return r.URL.Query.Get(key)
+}
@@ -0,0 +1,64 @@
+package request
+
+import "httpfromtcp/internal/httperr"
+
+// Limits bounds the size of a request. They are enforced while parsing, so an
+// oversized request is rejected before it is buffered. A zero limit means no
+// limit.
+type Limits struct {
+	MaxRequestLineBytes int   // request line, without CRLF
+	MaxHeaderLineBytes  int   // a single header or trailer field line, without CRLF
+	MaxHeaderBytes      int   // all header and trailer field lines together
+	MaxHeaderCount      int   // number of header and trailer field lines
+	MaxBodyBytes        int64 // body, after removing chunked framing
+}
+
+// DefaultLimits returns the limits used by NewReader
+func DefaultLimits() Limits {
+	return Limits{
+		MaxRequestLineBytes: 8 * 1024,
+		MaxHeaderLineBytes:  8 * 1024,
+		MaxHeaderBytes:      1024 * 1024,
+		MaxHeaderCount:      100,
+	}
+}
+
+// checkFieldLine enforces the header limits after Headers.Parse consumed n
+// bytes of data, n being 0 while the field line is incomplete
+func (r *Request) checkFieldLine(data []byte, n int, done bool) error {
+	l := r.limits
+	if n == 0 {
+		// Don't wait for the end of a line that is already too long
+		if l.MaxHeaderLineBytes > 0 && len(data) > l.MaxHeaderLineBytes+2 {
+			return httperr.New(httperr.KindHeadersTooLarge, r.offset, "field line longer than %d bytes", l.MaxHeaderLineBytes)
+		}
+		if l.MaxHeaderBytes > 0 && r.headerBytes+len(data) > l.MaxHeaderBytes {
+			return httperr.New(httperr.KindHeadersTooLarge, r.offset, "field lines longer than %d bytes", l.MaxHeaderBytes)
+		}
+		return nil
+	}
+
+	r.headerBytes += n
+	if !done {
+		r.headerCount++
+	}
+	if l.MaxHeaderLineBytes > 0 && n > l.MaxHeaderLineBytes+2 { // +2 for "\r\n"
+		return httperr.New(httperr.KindHeadersTooLarge, r.offset, "field line longer than %d bytes", l.MaxHeaderLineBytes)
+	}
+	if l.MaxHeaderBytes > 0 && r.headerBytes > l.MaxHeaderBytes {
+		return httperr.New(httperr.KindHeadersTooLarge, r.offset, "field lines longer than %d bytes", l.MaxHeaderBytes)
+	}
+	if l.MaxHeaderCount > 0 && r.headerCount > l.MaxHeaderCount {
+		return httperr.New(httperr.KindHeadersTooLarge, r.offset, "more than %d field lines", l.MaxHeaderCount)
+	}
+	return nil
+}
+
+// checkBodySize enforces the body limit once the body is known to be size bytes
+// long, or to be at least that long for a chunked body
+func (r *Request) checkBodySize(size int64) error {
+	if r.limits.MaxBodyBytes > 0 && size > r.limits.MaxBodyBytes {
+		return httperr.New(httperr.KindBodyTooLarge, r.offset, "body longer than %d bytes", r.limits.MaxBodyBytes)
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+package request
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"io"
+	"mime"
+	"path/filepath"
+)
+
+const (
+	multipartBufferSize   = 32 * 1024
+	maxPartHeaderBytes    = 16 * 1024
+	maxBoundaryLineLength = 1024 // boundary line, transport padding included
+)
+
+var (
+	ErrNotMultipart     = errors.New("request: content-type is not multipart/form-data")
+	ErrMissingBoundary  = errors.New("request: multipart content-type has no boundary")
+	ErrMultipartStarted = errors.New("request: multipart body already being read")
+)
+
+// MultipartReader streams the parts of a multipart/form-data body. Only the
+// part being read is buffered, and only up to multipartBufferSize bytes.
+type MultipartReader struct {
+	r         io.Reader
+	data      []byte // fixed-size buffer
+	buf       []byte // bytes read from r and not consumed yet, within data
+	delimiter []byte // "\r\n--" + boundary
+	part      *Part
+	done      bool
+	err       error // sticky error from r
+}
+
+// Part is one part of a multipart body. Reading it returns the part content
+// and io.EOF at the boundary ending it.
+type Part struct {
+	Headers  *headers.Headers
+	Name     string // name parameter of Content-Disposition
+	FileName string // filename parameter of Content-Disposition, base name only
+	mr       *MultipartReader
+	done     bool
+}
+
+// MultipartReader returns a reader for the parts of a multipart/form-data
+// body, for handlers that want to stream uploads themselves. Use it instead
+// of ParseMultipartForm, not together with it.
+func (r *Request) MultipartReader() (*MultipartReader, error) {
+	if r.multipart {
+		return nil, ErrMultipartStarted
+	}
+	contentType, _ := r.Headers.Get("Content-Type")
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != "multipart/form-data" {
+		return nil, ErrNotMultipart
+	}
+	boundary := params["boundary"]
+	if boundary == "" {
+		return nil, ErrMissingBoundary
+	}
+	r.multipart = true
+	return NewMultipartReader(r.Body, boundary), nil
+}
+
+// NewMultipartReader returns a reader for the parts of the multipart body in
+// r, delimited by boundary
+func NewMultipartReader(r io.Reader, boundary string) *MultipartReader {
+	return &MultipartReader{
+		r: r,
+		// The first delimiter has no CRLF before it, pretend there was one
+		buf:       []byte("\r\n"),
+		delimiter: []byte("\r\n--" + boundary),
+	}
+}
+
+// NextPart skips what is left of the current part and returns the next one,
+// or io.EOF after the last one
+func (mr *MultipartReader) NextPart() (*Part, error) {
+	if mr.part != nil {
+		if _, err := io.Copy(io.Discard, mr.part); err != nil {
+			return nil, err
+		}
+		mr.part = nil
+	}
+	if mr.done {
+		return nil, io.EOF
+	}
+
+	// Find the delimiter, skipping the preamble before the first part
+	for {
+		i, decided := mr.findDelimiter()
+		if i != -1 && decided {
+			mr.buf = mr.buf[i+len(mr.delimiter):]
+			break
+		}
+		// Keep what could be the start of a delimiter
+		if i != -1 {
+			mr.buf = mr.buf[i:]
+		} else if keep := len(mr.delimiter) - 1; len(mr.buf) > keep {
+			mr.buf = mr.buf[len(mr.buf)-keep:]
+		}
+		if err := mr.fill(); err != nil {
+			return nil, err
+		}
+	}
+
+	// The delimiter is followed by "--" after the last part, or by optional
+	// padding and CRLF before the next one
+	for {
+		if bytes.HasPrefix(mr.buf, []byte("--")) {
+			mr.done = true
+			return nil, io.EOF
+		}
+		if i := bytes.Index(mr.buf, []byte("\r\n")); i != -1 {
+			if len(bytes.Trim(mr.buf[:i], " \t")) != 0 {
+				return nil, fmt.Errorf("multipart: unexpected data after boundary: %q", mr.buf[:i])
+			}
+			mr.buf = mr.buf[i+2:]
+			break
+		}
+		if len(mr.buf) > maxBoundaryLineLength {
+			return nil, errors.New("multipart: boundary line too long")
+		}
+		if err := mr.fill(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Parse the part headers with the same parser as the request headers
+	part := &Part{Headers: headers.NewHeaders(), mr: mr}
+	headerBytes := 0
+	for {
+		n, done, err := part.Headers.Parse(mr.buf)
+		if err != nil {
+			return nil, fmt.Errorf("multipart: %w", err)
+		}
+		mr.buf = mr.buf[n:]
+		headerBytes += n
+		if done {
+			break
+		}
+		// The line being buffered counts as well, so an endless line is caught
+		if headerBytes > maxPartHeaderBytes || n == 0 && headerBytes+len(mr.buf) > maxPartHeaderBytes {
+			return nil, fmt.Errorf("multipart: part headers longer than %d bytes", maxPartHeaderBytes)
+		}
+		if n == 0 {
+			if err := mr.fill(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if disposition, ok := part.Headers.Get("Content-Disposition"); ok {
+		if _, params, err := mime.ParseMediaType(disposition); err == nil {
+			part.Name = params["name"]
+			if fileName := params["filename"]; fileName != "" {
+				part.FileName = filepath.Base(filepath.Clean("/" + fileName))
+			}
+		}
+	}
+	mr.part = part
+	return part, nil
+}
+
+// Read reads the content of the part, up to the delimiter ending it
+func (p *Part) Read(b []byte) (int, error) {
+	if p.done {
+		return 0, io.EOF
+	}
+	mr := p.mr
+	for {
+		i, decided := mr.findDelimiter()
+		if i == 0 && decided {
+			p.done = true
+			return 0, io.EOF
+		}
+		// Content before the delimiter, or before what could be its start
+		safe := i
+		if i == -1 {
+			safe = len(mr.buf) - (len(mr.delimiter) - 1)
+		}
+		if safe > 0 {
+			n := copy(b, mr.buf[:safe])
+			mr.buf = mr.buf[n:]
+			return n, nil
+		}
+		if err := mr.fill(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// findDelimiter returns the index in buf of the first delimiter followed by
+// "--" or by optional padding and CRLF, or -1. A boundary lookalike inside the
+// content is skipped. decided is false when the bytes after the delimiter at
+// the index are not buffered yet.
+func (mr *MultipartReader) findDelimiter() (i int, decided bool) {
+	from := 0
+	for {
+		i = bytes.Index(mr.buf[from:], mr.delimiter)
+		if i == -1 {
+			return -1, true
+		}
+		i += from
+		rest := mr.buf[i+len(mr.delimiter):]
+		padded := bytes.TrimLeft(rest, " \t")
+		switch {
+		case bytes.HasPrefix(rest, []byte("--")), bytes.HasPrefix(padded, []byte("\r\n")):
+			return i, true
+		case len(padded) == 0, string(padded) == "\r", string(rest) == "-":
+			return i, false
+		}
+		from = i + 1
+	}
+}
+
+// fill reads more of the body into buf. Running out of body before the
+// closing delimiter is an error.
+func (mr *MultipartReader) fill() error {
+	if mr.err != nil {
+		return mr.err
+	}
+	if len(mr.buf) >= multipartBufferSize {
+		return errors.New("multipart: line too long")
+	}
+	// Move the unread bytes to the front of the buffer
+	if mr.data == nil {
+		mr.data = make([]byte, multipartBufferSize)
+	}
+	mr.buf = mr.data[:copy(mr.data, mr.buf)]
+	n, err := mr.r.Read(mr.data[len(mr.buf):])
+	mr.buf = mr.data[:len(mr.buf)+n]
+	if err == io.EOF {
+		if n > 0 {
+			return nil
+		}
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		mr.err = fmt.Errorf("multipart: %w", err)
+		return mr.err
+	}
+	return nil
+}
@@ -1,96 +1,230 @@
 package request
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/httperr"
 	"io"
-	"strconv"
 	"strings"
 )
 
 const (
-	bufferSize                 = 4096
-	requestStateInitialized    = 1
-	requestStateParsingHeaders = 2
-	requestStateParseingBody   = 3
-	requestStateDone           = 4
+	bufferSize                   = 4096
+	requestStateInitialized      = 1
+	requestStateParsingHeaders   = 2
+	requestStateParseingBody     = 3
+	requestStateParsingChunkSize = 4
+	requestStateParsingChunkData = 5
+	requestStateParsingTrailers  = 6
+	requestStateDone             = 7
 )
 
+// ParseError is the error returned for malformed requests. Use errors.Is with
+// an httperr.Kind to test for a category, e.g. errors.Is(err, httperr.KindBadMethod).
+type ParseError = httperr.ParseError
+
 type Request struct {
-	RequestLine RequestLine
-	Headers     headers.Headers
-	Body        []byte
-	state       int
+	RequestLine    RequestLine
+	URL            *URL // parsed RequestLine.RequestTarget
+	Headers        *headers.Headers
+	Body           io.ReadCloser    // streamed from the connection on demand
+	ContentLength  int64            // declared body length, -1 for chunked bodies
+	Trailers       *headers.Headers // trailer fields of a chunked body
+	Form           Query            // form body fields, set by ParseForm or ParseMultipartForm
+	MultipartForm  *MultipartForm   // set by ParseMultipartForm
+	RemoteAddr     string           // address of the client, set by the server
+	state          int
+	headerBytes    int
+	headerCount    int
+	bodyBytes      int64 // chunk data announced so far
+	limits         Limits
+	multipart      bool // body handed to a MultipartReader
+	offset         int  // bytes of the request parsed so far
+	chunkRemaining int64
+	pathValues     map[string]string
+	ctx            context.Context
 }
 
 type RequestLine struct {
-	HttpVersion   string
+	HttpVersion   string // e.g. "1.1"
+	Major         int
+	Minor         int
 	RequestTarget string
 	Method        string
 }
 
+// ProtoAtLeast reports whether the request version is at least major.minor
+func (rl RequestLine) ProtoAtLeast(major, minor int) bool {
+	return rl.Major > major || rl.Major == major && rl.Minor >= minor
+}
+
+// Context returns the context of the request. For requests received by the
+// server it is cancelled when the server is closed, the handler timeout
+// expires or the client disconnects. A disconnect is only noticed once the
+// body, if any, has been read to the end: until then the connection is busy
+// carrying it. It is never nil.
+func (r *Request) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	return context.Background()
+}
+
+// WithContext returns a shallow copy of r with its context changed to ctx,
+// e.g. for middleware attaching request-scoped values
+func (r *Request) WithContext(ctx context.Context) *Request {
+	if ctx == nil {
+		panic("nil context")
+	}
+	r2 := new(Request)
+	*r2 = *r
+	r2.ctx = ctx
+	return r2
+}
+
+// PathValue returns the value captured for the named path parameter by the
+// router, or "" if there is none
+func (r *Request) PathValue(name string) string {
+	return r.pathValues[name]
+}
+
+// SetPathValue stores a captured path parameter on the request
+func (r *Request) SetPathValue(name, value string) {
+	if r.pathValues == nil {
+		r.pathValues = make(map[string]string)
+	}
+	r.pathValues[name] = value
+}
+
 func PrintRequestLine(r *Request) {
 	fmt.Println("Request line:")
 	fmt.Println("- Method: " + r.RequestLine.Method)
 	fmt.Println("- Target: " + r.RequestLine.RequestTarget)
 	fmt.Println("- Version: " + r.RequestLine.HttpVersion)
 	fmt.Println("Headers:")
-	for key, value := range r.Headers {
-		fmt.Printf("- %s: %s\n", key, value)
+	for _, f := range r.Headers.Fields() {
+		fmt.Printf("- %s: %s\n", f.Name, f.Value)
 	}
 	fmt.Println("Body:")
-	fmt.Println(string(r.Body))
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		fmt.Println("error reading body:", err)
+	}
+	fmt.Println(string(body))
+	if r.Trailers.Len() > 0 {
+		fmt.Println("Trailers:")
+		for _, f := range r.Trailers.Fields() {
+			fmt.Printf("- %s: %s\n", f.Name, f.Value)
+		}
+	}
 }
 
 func parseLineRequest(r *Request, data []byte) (bytesParsed int, err error) {
 
 	request := string(data)
 	//Check at least one "\r\n" and do nothing with the rest
-	if strings.Count(request, "\r\n") < 1 {
-		return 0, nil
-	}
-
-	requestParts := strings.Split(request, "\r\n")
-	if len(requestParts) == 0 {
+	lineEnd := strings.Index(request, "\r\n")
+	if lineEnd == -1 {
+		if max := r.limits.MaxRequestLineBytes; max > 0 && len(request) > max+2 {
+			return 0, httperr.New(httperr.KindRequestLineTooLong, max, "longer than %d bytes", max)
+		}
 		return 0, nil
 	}
 
-	requestLine := requestParts[0]
+	requestLine := request[:lineEnd]
 	if requestLine == "" {
-		return 0, fmt.Errorf("request line is empty")
+		return 0, httperr.New(httperr.KindMalformedRequestLine, 0, "request line is empty")
+	}
+	if max := r.limits.MaxRequestLineBytes; max > 0 && len(requestLine) > max {
+		return 0, httperr.New(httperr.KindRequestLineTooLong, max, "longer than %d bytes", max)
 	}
 
 	parts := strings.Split(requestLine, " ")
+	if len(parts) != 3 {
+		return 0, httperr.New(httperr.KindMalformedRequestLine, 0, "expected method, target and version separated by single spaces: %q", requestLine)
+	}
+	method, target, version := parts[0], parts[1], parts[2]
+	targetOffset := len(method) + 1
+	versionOffset := targetOffset + len(target) + 1
 
 	//check if Method has only capital letters
-	for i := 0; i < len(parts[0]); i++ {
-		if parts[0][i] < 'A' || parts[0][i] > 'Z' {
-			return 0, fmt.Errorf("invalid method, must contain only capital letters")
+	if method == "" {
+		return 0, httperr.New(httperr.KindBadMethod, 0, "method is empty")
+	}
+	for i := 0; i < len(method); i++ {
+		if method[i] < 'A' || method[i] > 'Z' {
+			return 0, httperr.New(httperr.KindBadMethod, i, "must contain only capital letters: %q", method)
 		}
 	}
 
-	//check if HttpVersion is only "HTTP/1.1"
-	if parts[2] != "HTTP/1.1" {
-		return 0, fmt.Errorf("invalid HTTP Version, only HTTP/1.1 is supported")
+	//check the target is present and has no control characters
+	if target == "" {
+		return 0, httperr.New(httperr.KindBadTarget, targetOffset, "request target is empty")
+	}
+	for i := 0; i < len(target); i++ {
+		if target[i] < ' ' || target[i] == 0x7f {
+			return 0, httperr.New(httperr.KindBadTarget, targetOffset+i, "illegal character %q", target[i])
+		}
 	}
 
-	r.RequestLine.Method = parts[0]
-	r.RequestLine.RequestTarget = parts[1]
-	r.RequestLine.HttpVersion = "1.1"
+	//check if HttpVersion is a well-formed HTTP/1.x, a well-formed version we
+	//don't speak gets its own kind, anything else is malformed
+	if !isHTTPVersion(version) {
+		return 0, httperr.New(httperr.KindBadVersion, versionOffset, "%q", version)
+	}
+	major, minor := int(version[5]-'0'), int(version[7]-'0')
+	if major != 1 {
+		return 0, httperr.New(httperr.KindUnsupportedVersion, versionOffset, "%q, only HTTP/1.x is supported", version)
+	}
+
+	url, err := ParseTarget(method, target)
+	if err != nil {
+		return 0, offsetBy(err, targetOffset)
+	}
+
+	r.URL = url
+	r.RequestLine.Method = method
+	r.RequestLine.RequestTarget = target
+	r.RequestLine.HttpVersion = version[len("HTTP/"):]
+	r.RequestLine.Major = major
+	r.RequestLine.Minor = minor
 	r.state = requestStateParsingHeaders
 	bytesParsed = len(requestLine) + 2 // +2 for "\r\n"
 	return bytesParsed, nil
 }
 
+// offsetBy shifts the offset of a ParseError from the start of the parsed
+// data to the start of the request
+func offsetBy(err error, offset int) error {
+	var pe *ParseError
+	if errors.As(err, &pe) {
+		pe.Offset += offset
+	}
+	return err
+}
+
+// isHTTPVersion reports whether version has the form "HTTP/x.y"
+func isHTTPVersion(version string) bool {
+	if len(version) != len("HTTP/x.y") || !strings.HasPrefix(version, "HTTP/") || version[6] != '.' {
+		return false
+	}
+	return '0' <= version[5] && version[5] <= '9' && '0' <= version[7] && version[7] <= '9'
+}
+
 func (r *Request) parse(data []byte) (int, error) {
 	totalBytesParsed := 0
 
-	for r.state != requestStateDone {
+	// The body is not parsed here, it is streamed by the body reader
+	for r.state < requestStateParseingBody {
 		bytesParsed, err := r.parseSingle(data[totalBytesParsed:])
 		if err != nil {
 			return totalBytesParsed, err
 		}
 		totalBytesParsed += bytesParsed
+		r.offset += bytesParsed
 		if bytesParsed == 0 {
 			return totalBytesParsed, nil
 		}
@@ -112,6 +246,10 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 	case requestStateParsingHeaders: // "parsing headers" state
 		bytesParsed, done, err := r.Headers.Parse(data)
 		if err != nil {
+			return bytesParsed, offsetBy(err, r.offset)
+		}
+		// The field line being buffered counts as well, so an endless line is caught
+		if err := r.checkFieldLine(data, bytesParsed, done); err != nil {
 			return bytesParsed, err
 		}
 		if done {
@@ -119,34 +257,6 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 			return bytesParsed, nil
 		}
 		return bytesParsed, nil
-	case requestStateParseingBody: // "parsing body" state
-		// Check if there is "contect-length" header
-		contentLengthStr, ok := r.Headers.Get("content-length")
-		if ok {
-			// If there is, read the body until the content length is reached
-			// Convert contentLength to int
-			contentLength, err := strconv.Atoi(contentLengthStr)
-			if err != nil {
-				return bytesParsed, fmt.Errorf("invalid content-length value: %v", err)
-			}
-
-			// Check if the body is complete
-			if len(data) < contentLength {
-				return bytesParsed, nil
-			} else if len(data) > contentLength {
-				return bytesParsed, fmt.Errorf("error: body is greater than content-length value")
-			}
-
-			// If reached here, the body is equal to content-length value
-			// Copy the body to the request and change the state to done
-			r.Body = data[:contentLength]
-			r.state = requestStateDone
-			return bytesParsed + contentLength, nil
-		} else {
-			// If there is no content length, go to done state
-			r.state = requestStateDone
-			return bytesParsed + len(data), nil
-		}
 	case requestStateDone: // "done" state
 		return 0, fmt.Errorf("error: request is already done")
 	default: // unknown state
@@ -154,41 +264,146 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 	}
 }
 
-func RequestFromReader(reader io.Reader) (*Request, error) {
-	readToIndex := 0
-	var r = Request{
+// Reader reads consecutive requests off a single connection. Bytes read past
+// the end of one request are kept in the buffer for the next one.
+type Reader struct {
+	reader      io.Reader
+	buf         []byte
+	readToIndex int
+	err         error
+	body        *body // body of the current request
+	limits      Limits
+}
+
+// NewReader returns a Reader enforcing DefaultLimits
+func NewReader(reader io.Reader) *Reader {
+	return NewReaderWithLimits(reader, DefaultLimits())
+}
+
+func NewReaderWithLimits(reader io.Reader, limits Limits) *Reader {
+	return &Reader{
+		reader: reader,
+		buf:    make([]byte, bufferSize),
+		limits: limits,
+	}
+}
+
+func newRequest(limits Limits) *Request {
+	return &Request{
+		limits:      limits,
 		RequestLine: RequestLine{},
 		Headers:     headers.NewHeaders(),
-		Body:        make([]byte, 0),
+		Body:        NoBody,
+		Trailers:    headers.NewHeaders(),
 		state:       requestStateInitialized,
 	}
-	buf := make([]byte, bufferSize)
-	for r.state != requestStateDone {
-		if readToIndex == len(buf) { // If the buffer is full
-			newBuf := make([]byte, len(buf)*2) // Create a new slice that's twice the size
-			copy(newBuf, buf)                  // Copy the old data into the new slice
-			buf = newBuf                       // Replace the old buffer with the new one
+}
+
+// ReadRequest parses the request line and headers of the next request on the
+// connection. The body is not read: it is streamed from the connection as
+// r.Body is read, so it must be consumed (or discarded with FinishBody)
+// before the next request can be read. It returns io.EOF if the stream ends
+// cleanly before any byte of a new request was read.
+func (rr *Reader) ReadRequest() (*Request, error) {
+	r := newRequest(rr.limits)
+	if err := rr.readUntil(r, requestStateParseingBody); err != nil {
+		return nil, err
+	}
+	if err := rr.setupBody(r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// WaitForRequest blocks until the first bytes of the next request are
+// buffered. It returns io.EOF if the stream ends cleanly before that.
+func (rr *Reader) WaitForRequest() error {
+	for rr.readToIndex == 0 {
+		if rr.err != nil {
+			return rr.err
 		}
-		numBytesRead, err := reader.Read(buf[readToIndex:])
+		rr.fill()
+	}
+	return nil
+}
+
+// readUntil parses buffered data and reads more from the stream until the
+// request reaches state.
+func (rr *Reader) readUntil(r *Request, state int) error {
+	for {
+		// Parse what is already buffered first, a pipelined request may be complete
+		parsedBytes, err := r.parse(rr.buf[:rr.readToIndex])
 		if err != nil {
-			if err == io.EOF {
-				if r.state != requestStateDone {
-					return nil, fmt.Errorf("error: unexpected end of stream")
+			return err
+		}
+
+		// Remove parsed data from the buffer
+		rr.consume(parsedBytes)
+
+		if r.state >= state {
+			return nil
+		}
+
+		if rr.err != nil {
+			if rr.err == io.EOF {
+				if r.state == requestStateInitialized && rr.readToIndex == 0 {
+					return io.EOF
 				}
-				break
 			}
-			return nil, err
+			return rr.unexpectedEnd(r)
 		}
-		readToIndex += numBytesRead
 
-		parsedBytes, err := r.parse(buf[:readToIndex])
-		if err != nil {
-			return nil, err
-		}
+		rr.fill()
+	}
+}
 
-		// Remove parsed data from the buffer
-		copy(buf, buf[parsedBytes:readToIndex])
-		readToIndex -= parsedBytes
+// unexpectedEnd returns the error for a stream that ended, or failed, in the
+// middle of request r
+func (rr *Reader) unexpectedEnd(r *Request) error {
+	if rr.err != io.EOF {
+		return rr.err
+	}
+	// Say which part was cut short
+	kind := httperr.KindUnexpectedEOF
+	if r.state == requestStateParseingBody {
+		kind = httperr.KindContentLengthMismatch
+	}
+	return httperr.Wrap(kind, r.offset+rr.readToIndex, io.ErrUnexpectedEOF, "")
+}
+
+// consume removes n parsed bytes from the front of the buffer
+func (rr *Reader) consume(n int) {
+	copy(rr.buf, rr.buf[n:rr.readToIndex])
+	rr.readToIndex -= n
+}
+
+// fill reads once from the stream into the free space of the buffer
+func (rr *Reader) fill() {
+	if rr.readToIndex == len(rr.buf) { // If the buffer is full
+		newBuf := make([]byte, len(rr.buf)*2) // Create a new slice that's twice the size
+		copy(newBuf, rr.buf)                  // Copy the old data into the new slice
+		rr.buf = newBuf                       // Replace the old buffer with the new one
+	}
+	numBytesRead, err := rr.reader.Read(rr.buf[rr.readToIndex:])
+	rr.readToIndex += numBytesRead
+	// Keep the error until the bytes that came with it have been parsed
+	rr.err = err
+}
+
+// RequestFromReader reads a single request, body included, from reader. The
+// whole body is buffered in memory, servers should use a Reader instead.
+func RequestFromReader(reader io.Reader) (*Request, error) {
+	r, err := NewReader(reader).ReadRequest()
+	if err == io.EOF {
+		return nil, httperr.Wrap(httperr.KindUnexpectedEOF, 0, io.ErrUnexpectedEOF, "empty stream")
+	}
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
 	}
-	return &r, nil
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return r, nil
 }
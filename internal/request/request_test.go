@@ -1,7 +1,11 @@
 package request
 
 import (
+	"fmt"
+	"httpfromtcp/internal/httperr"
 	"io"
+	"os"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -34,6 +38,19 @@ func TestRequestLineParse(t *testing.T) {
 	assert.Equal(t, "/coffee", r.RequestLine.RequestTarget)
 	assert.Equal(t, "1.1", r.RequestLine.HttpVersion)
 
+	// Test: Good HTTP/1.0 Request line
+	reader = &chunkReader{
+		data:            "GET /coffee HTTP/1.0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "1.0", r.RequestLine.HttpVersion)
+	assert.Equal(t, 1, r.RequestLine.Major)
+	assert.Equal(t, 0, r.RequestLine.Minor)
+	assert.True(t, r.RequestLine.ProtoAtLeast(1, 0))
+	assert.False(t, r.RequestLine.ProtoAtLeast(1, 1))
+
 	// Test: Invalid number of parts in request line
 	reader = &chunkReader{
 		data:            "/coffee HTTP/1.1\r\nHost: localhost:42069\r\nUser-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n",
@@ -75,9 +92,9 @@ func TestFieldLineParse(t *testing.T) {
 	r, err := RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "localhost:42069", r.Headers["host"])
-	assert.Equal(t, "curl/7.81.0", r.Headers["user-agent"])
-	assert.Equal(t, "*/*", r.Headers["accept"])
+	assert.Equal(t, []string{"localhost:42069"}, r.Headers.Values("host"))
+	assert.Equal(t, []string{"curl/7.81.0"}, r.Headers.Values("user-agent"))
+	assert.Equal(t, []string{"*/*"}, r.Headers.Values("accept"))
 
 	// Test: Missing End of Header
 	reader = &chunkReader{
@@ -123,15 +140,24 @@ func TestFieldLineParse(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, 0, len(r.Headers))
+	assert.Equal(t, 0, r.Headers.Len())
 
-	// Test: Duplicate Headers
+	// Test: Duplicate Headers are kept as separate lines
 	reader = &chunkReader{
-		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\nHost: localhost:42069\r\n\r\n",
+		data:            "GET / HTTP/1.1\r\nSet-Cookie: a=1\r\nSet-Cookie: a=1\r\n\r\n",
 		numBytesPerRead: 3,
 	}
 	r, err = RequestFromReader(reader)
-	require.Error(t, err)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a=1", "a=1"}, r.Headers.Values("set-cookie"))
+
+	// Test: Conflicting Content-Length lines
+	reader = &chunkReader{
+		data:            "POST / HTTP/1.1\r\nContent-Length: 3\r\nContent-Length: 4\r\n\r\nabcd",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, httperr.KindBadContentLength)
 	require.Nil(t, r)
 
 	// Test: Case Insensitive Headers
@@ -142,9 +168,9 @@ func TestFieldLineParse(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "localhost:42069, localhost:69420", r.Headers["host"])
-	assert.Equal(t, "curl/7.81.0", r.Headers["user-agent"])
-	assert.Equal(t, "*/*", r.Headers["accept"])
+	assert.Equal(t, []string{"localhost:42069", "localhost:69420"}, r.Headers.Values("host"))
+	assert.Equal(t, []string{"curl/7.81.0"}, r.Headers.Values("user-agent"))
+	assert.Equal(t, []string{"*/*"}, r.Headers.Values("accept"))
 }
 
 func TestBodyParse(t *testing.T) {
@@ -160,7 +186,7 @@ func TestBodyParse(t *testing.T) {
 	r, err := RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "hello world!\n", string(r.Body))
+	assert.Equal(t, "hello world!\n", readBody(t, r))
 
 	// Test: Empty Body - 0 Content-Length
 	reader = &chunkReader{
@@ -174,7 +200,7 @@ func TestBodyParse(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "", string(r.Body))
+	assert.Equal(t, "", readBody(t, r))
 
 	// Test: Empty Body - No Content-Length
 	reader = &chunkReader{
@@ -187,7 +213,7 @@ func TestBodyParse(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "", string(r.Body))
+	assert.Equal(t, "", readBody(t, r))
 
 	// Test: Body shorter than reported content length
 	reader = &chunkReader{
@@ -213,7 +239,365 @@ func TestBodyParse(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "", string(r.Body))
+	assert.Equal(t, "", readBody(t, r))
+}
+
+func TestChunkedBodyParse(t *testing.T) {
+	// Test: Chunked body with an extension
+	reader := &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"6\r\nhello \r\n" +
+			"7;name=value\r\nworld!\n\r\n" +
+			"0\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "hello world!\n", readBody(t, r))
+	assert.Equal(t, 0, r.Trailers.Len())
+
+	// Test: Chunked body with trailers
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"Trailer: X-Checksum\r\n" +
+			"\r\n" +
+			"A\r\n0123456789\r\n" +
+			"0\r\n" +
+			"X-Checksum: abc123\r\n" +
+			"\r\n",
+		numBytesPerRead: 5,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "0123456789", readBody(t, r))
+	assert.Equal(t, []string{"abc123"}, r.Trailers.Values("x-checksum"))
+
+	// Test: Both Content-Length and Transfer-Encoding
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Content-Length: 5\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, httperr.KindAmbiguousFraming)
+	require.Nil(t, r)
+
+	// Test: Invalid chunk size
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"zz\r\nhello\r\n0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, httperr.KindBadChunk)
+	require.Nil(t, r)
+
+	// Test: Signed chunk sizes
+	for _, size := range []string{"-40", "+5"} {
+		reader = &chunkReader{
+			data: "POST /submit HTTP/1.1\r\n" +
+				"Transfer-Encoding: chunked\r\n" +
+				"\r\n" +
+				size + "\r\nhello\r\n0\r\n\r\n",
+			numBytesPerRead: 3,
+		}
+		r, err = RequestFromReader(reader)
+		require.ErrorIs(t, err, httperr.KindBadChunk, size)
+		require.Nil(t, r)
+	}
+
+	// Test: Chunk size followed by something else than an extension
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"5 garbage\r\nhello\r\n0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, httperr.KindBadChunk)
+	require.Nil(t, r)
+
+	// Test: Whitespace before an extension is tolerated
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"5 ;ext\r\nhello\r\n0 \r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", readBody(t, r))
+
+	// Test: Chunk data longer than its size
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"3\r\nhello\r\n0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, httperr.KindBadChunk)
+	require.Nil(t, r)
+
+	// Test: Missing terminating chunk
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"5\r\nhello\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	require.Nil(t, r)
+}
+
+func TestReaderMultipleRequests(t *testing.T) {
+	// Test: Two pipelined requests on the same stream
+	reader := NewReader(&chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"hello" +
+			"GET /coffee HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"\r\n",
+		numBytesPerRead: 7,
+	})
+	r, err := reader.ReadRequest()
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "/submit", r.RequestLine.RequestTarget)
+	assert.Equal(t, "hello", readBody(t, r))
+
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "/coffee", r.RequestLine.RequestTarget)
+	assert.Equal(t, "", readBody(t, r))
+
+	// Test: Clean end of stream between requests
+	r, err = reader.ReadRequest()
+	require.ErrorIs(t, err, io.EOF)
+	require.Nil(t, r)
+
+	// Test: End of stream in the middle of a request
+	reader = NewReader(&chunkReader{
+		data:            "GET /coffee HTTP/1.1\r\nHost: localhost:42069\r\n",
+		numBytesPerRead: 7,
+	})
+	r, err = reader.ReadRequest()
+	require.Error(t, err)
+	require.NotErrorIs(t, err, io.EOF)
+	require.Nil(t, r)
+}
+
+func TestRequestErrors(t *testing.T) {
+	// Test: Unsupported HTTP version
+	reader := &chunkReader{
+		data:            "GET / HTTP/2.0\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.ErrorIs(t, err, httperr.KindUnsupportedVersion)
+	require.Nil(t, r)
+
+	// Test: HTTP/0.9 is not supported either
+	reader = &chunkReader{
+		data:            "GET / HTTP/0.9\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, httperr.KindUnsupportedVersion)
+	require.Nil(t, r)
+
+	// Test: Transfer-Encoding in an HTTP/1.0 request
+	reader = &chunkReader{
+		data:            "POST / HTTP/1.0\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, httperr.KindAmbiguousFraming)
+	require.Nil(t, r)
+
+	// Test: Malformed HTTP version
+	reader = &chunkReader{
+		data:            "GET / HTTP/one\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, httperr.KindBadVersion)
+	require.Nil(t, r)
+	var pe *ParseError
+	require.ErrorAs(t, err, &pe)
+	assert.Equal(t, 6, pe.Offset)
+
+	// Test: Missing HTTP version
+	reader = &chunkReader{
+		data:            "GET /\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, httperr.KindMalformedRequestLine)
+	require.Nil(t, r)
+
+	// Test: Bad method
+	reader = &chunkReader{
+		data:            "GeT / HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, httperr.KindBadMethod)
+	require.ErrorAs(t, err, &pe)
+	assert.Equal(t, 1, pe.Offset)
+	require.Nil(t, r)
+
+	// Test: Bad field name, offset counted from the start of the request
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\nUser Agent: curl\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, httperr.KindBadFieldName)
+	require.ErrorAs(t, err, &pe)
+	assert.Equal(t, 43, pe.Offset)
+	require.Nil(t, r)
+
+	// Test: Bad content-length
+	reader = &chunkReader{
+		data:            "POST /submit HTTP/1.1\r\nContent-Length: -5\r\n\r\nhello",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, httperr.KindBadContentLength)
+	require.Nil(t, r)
+
+	// Test: Body shorter than content-length
+	reader = &chunkReader{
+		data:            "POST /submit HTTP/1.1\r\nContent-Length: 10\r\n\r\nhello",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, httperr.KindContentLengthMismatch)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	require.Nil(t, r)
+
+	// Test: Request line too long
+	reader = &chunkReader{
+		data:            "GET /" + strings.Repeat("a", DefaultLimits().MaxRequestLineBytes) + " HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 1024,
+	}
+	r, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, httperr.KindRequestLineTooLong)
+	require.Nil(t, r)
+
+	// Test: Unsupported transfer coding
+	reader = &chunkReader{
+		data:            "POST /submit HTTP/1.1\r\nTransfer-Encoding: gzip\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, httperr.KindUnsupportedTransferEncoding)
+	require.Nil(t, r)
+}
+
+func TestStreamingBody(t *testing.T) {
+	// Test: Headers are returned before the body is read
+	reader := NewReader(&chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Content-Length: 11\r\n" +
+			"\r\n" +
+			"hello world" +
+			"GET /next HTTP/1.1\r\n" +
+			"\r\n",
+		numBytesPerRead: 4,
+	})
+	r, err := reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, int64(11), r.ContentLength)
+	buf := make([]byte, 5)
+	n, err := io.ReadFull(r.Body, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf[:n]))
+
+	// Test: Unread remainder is discarded before the next request
+	assert.True(t, reader.CanDiscardBody(6))
+	assert.False(t, reader.CanDiscardBody(5))
+	require.NoError(t, reader.FinishBody(1024))
+	assert.True(t, reader.CanDiscardBody(0))
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/next", r.RequestLine.RequestTarget)
+	assert.Equal(t, NoBody, r.Body)
+
+	// Test: Remainder larger than the discard limit
+	reader = NewReader(&chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Content-Length: 100\r\n" +
+			"\r\n" +
+			strings.Repeat("a", 100),
+		numBytesPerRead: 10,
+	})
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	require.Error(t, reader.FinishBody(10))
+
+	// Test: Body cut short surfaces when reading it
+	reader = NewReader(&chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Content-Length: 100\r\n" +
+			"\r\n" +
+			"short",
+		numBytesPerRead: 10,
+	})
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	_, err = io.ReadAll(r.Body)
+	require.ErrorIs(t, err, httperr.KindContentLengthMismatch)
+
+	// Test: Reading after Close
+	reader = NewReader(&chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"5\r\nhello\r\n0\r\n\r\n",
+		numBytesPerRead: 10,
+	})
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, int64(-1), r.ContentLength)
+	require.NoError(t, r.Body.Close())
+	_, err = r.Body.Read(buf)
+	require.ErrorIs(t, err, ErrBodyReadAfterClose)
+	// The size of an unread chunked body is unknown
+	assert.False(t, reader.CanDiscardBody(1024))
+	require.NoError(t, reader.FinishBody(1024))
+	assert.True(t, reader.CanDiscardBody(0))
+}
+
+// readBody reads the whole request body as a string
+func readBody(t *testing.T, r *Request) string {
+	t.Helper()
+	body, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	return string(body)
 }
 
 type chunkReader struct {
@@ -240,3 +624,262 @@ func (cr *chunkReader) Read(p []byte) (n int, err error) {
 	}
 	return n, nil
 }
+
+func TestLimits(t *testing.T) {
+	limits := Limits{
+		MaxRequestLineBytes: 32,
+		MaxHeaderLineBytes:  32,
+		MaxHeaderBytes:      64,
+		MaxHeaderCount:      3,
+		MaxBodyBytes:        8,
+	}
+	readWithLimits := func(data string) (*Request, error) {
+		return NewReaderWithLimits(&chunkReader{data: data, numBytesPerRead: 3}, limits).ReadRequest()
+	}
+
+	// Test: Request within every limit
+	r, err := readWithLimits("POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Length: 8\r\n\r\n12345678")
+	require.NoError(t, err)
+	body, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "12345678", string(body))
+
+	// Test: Request line too long, rejected before its end is read
+	_, err = readWithLimits("GET /" + strings.Repeat("a", 1024))
+	require.ErrorIs(t, err, httperr.KindRequestLineTooLong)
+
+	// Test: Single field line too long, rejected before its end is read
+	_, err = readWithLimits("GET / HTTP/1.1\r\nX-Long: " + strings.Repeat("a", 1024))
+	require.ErrorIs(t, err, httperr.KindHeadersTooLarge)
+
+	// Test: Too many field lines
+	_, err = readWithLimits("GET / HTTP/1.1\r\nA: 1\r\nB: 2\r\nC: 3\r\nD: 4\r\n\r\n")
+	require.ErrorIs(t, err, httperr.KindHeadersTooLarge)
+
+	// Test: Field lines too long together
+	_, err = readWithLimits("GET / HTTP/1.1\r\nA: " + strings.Repeat("a", 25) +
+		"\r\nB: " + strings.Repeat("b", 25) + "\r\nC: " + strings.Repeat("c", 25) + "\r\n\r\n")
+	require.ErrorIs(t, err, httperr.KindHeadersTooLarge)
+
+	// Test: Content-Length over the body limit
+	_, err = readWithLimits("POST /upload HTTP/1.1\r\nContent-Length: 9\r\n\r\n123456789")
+	require.ErrorIs(t, err, httperr.KindBodyTooLarge)
+
+	// Test: Chunked body over the body limit
+	r, err = readWithLimits("POST /upload HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"5\r\n12345\r\n5\r\n67890\r\n0\r\n\r\n")
+	require.NoError(t, err)
+	_, err = io.ReadAll(r.Body)
+	require.ErrorIs(t, err, httperr.KindBodyTooLarge)
+
+	// Test: A negative chunk can't make room under the body limit
+	r, err = readWithLimits("POST /upload HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"-40\r\n\r\nc\r\n123456789012\r\n0\r\n\r\n")
+	if err == nil {
+		_, err = io.ReadAll(r.Body)
+	}
+	require.ErrorIs(t, err, httperr.KindBadChunk)
+
+	// Test: Zero limits disable the checks
+	r, err = NewReaderWithLimits(&chunkReader{
+		data:            "GET /" + strings.Repeat("a", 1024) + " HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 64,
+	}, Limits{}).ReadRequest()
+	require.NoError(t, err)
+	assert.Len(t, r.RequestLine.RequestTarget, 1025)
+}
+
+func TestParseTarget(t *testing.T) {
+	// Test: Origin-form with a query
+	u, err := ParseTarget("GET", "/search/a%20b?q=go+lang&tag=x&tag=y&empty")
+	require.NoError(t, err)
+	assert.Equal(t, TargetOrigin, u.Form)
+	assert.Equal(t, "/search/a b", u.Path)
+	assert.Equal(t, "/search/a%20b", u.RawPath)
+	assert.Equal(t, "q=go+lang&tag=x&tag=y&empty", u.RawQuery)
+	assert.Equal(t, "go lang", u.Query.Get("q"))
+	assert.Equal(t, []string{"x", "y"}, u.Query["tag"])
+	assert.True(t, u.Query.Has("empty"))
+	assert.False(t, u.Query.Has("missing"))
+
+	// Test: Dot-segments are removed, encoded ones too
+	u, err = ParseTarget("GET", "/static/../secret")
+	require.NoError(t, err)
+	assert.Equal(t, "/secret", u.Path)
+	u, err = ParseTarget("GET", "/static/%2e%2e/%2E%2E/secret/")
+	require.NoError(t, err)
+	assert.Equal(t, "/secret/", u.Path)
+
+	// Test: Segments are split before decoding and cleaned like Path
+	u, err = ParseTarget("GET", "/users/a%2Fb/./x/..//%2e%2e/c%20d/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"users", "c d", ""}, u.Segments())
+	u, err = ParseTarget("GET", "/users/a%2Fb")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"users", "a/b"}, u.Segments())
+	u, err = ParseTarget("GET", "/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{""}, u.Segments())
+
+	// Test: Absolute-form
+	u, err = ParseTarget("GET", "HTTP://example.com:8080/a/./b?x=1")
+	require.NoError(t, err)
+	assert.Equal(t, TargetAbsolute, u.Form)
+	assert.Equal(t, "http", u.Scheme)
+	assert.Equal(t, "example.com:8080", u.Host)
+	assert.Equal(t, "/a/b", u.Path)
+	assert.Equal(t, "1", u.Query.Get("x"))
+	u, err = ParseTarget("GET", "http://example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "/", u.Path)
+
+	// Test: Authority-form
+	u, err = ParseTarget("CONNECT", "example.com:443")
+	require.NoError(t, err)
+	assert.Equal(t, TargetAuthority, u.Form)
+	assert.Equal(t, "example.com:443", u.Host)
+	_, err = ParseTarget("CONNECT", "/path")
+	require.ErrorIs(t, err, httperr.KindBadTarget)
+
+	// Test: Asterisk-form
+	u, err = ParseTarget("OPTIONS", "*")
+	require.NoError(t, err)
+	assert.Equal(t, TargetAsterisk, u.Form)
+	_, err = ParseTarget("GET", "*")
+	require.ErrorIs(t, err, httperr.KindBadTarget)
+
+	// Test: Bad percent-encoding, offset relative to the target
+	_, err = ParseTarget("GET", "/a%zz")
+	require.ErrorIs(t, err, httperr.KindBadTarget)
+	var pe *ParseError
+	require.ErrorAs(t, err, &pe)
+	assert.Equal(t, 2, pe.Offset)
+	_, err = ParseTarget("GET", "/a?x=%4")
+	require.ErrorIs(t, err, httperr.KindBadTarget)
+	_, err = ParseTarget("GET", "/a%00b")
+	require.ErrorIs(t, err, httperr.KindBadTarget)
+
+	// Test: Fragments and relative targets are rejected
+	_, err = ParseTarget("GET", "/a#frag")
+	require.ErrorIs(t, err, httperr.KindBadTarget)
+	_, err = ParseTarget("GET", "a/b")
+	require.ErrorIs(t, err, httperr.KindBadTarget)
+
+	// Test: Offsets are relative to the request once parsed
+	_, err = RequestFromReader(strings.NewReader("GET /a%zz HTTP/1.1\r\n\r\n"))
+	require.ErrorAs(t, err, &pe)
+	assert.Equal(t, 6, pe.Offset)
+}
+
+func TestParseForm(t *testing.T) {
+	// Test: urlencoded body, query as fallback
+	r, err := NewReader(strings.NewReader("POST /submit?lang=go&name=query HTTP/1.1\r\n" +
+		"Content-Type: application/x-www-form-urlencoded; charset=utf-8\r\n" +
+		"Content-Length: 27\r\n" +
+		"\r\n" +
+		"name=Ada+Lovelace&tag=a&tag")).ReadRequest()
+	require.NoError(t, err)
+	require.NoError(t, r.ParseForm())
+	assert.Equal(t, "Ada Lovelace", r.FormValue("name"))
+	assert.Equal(t, []string{"a", ""}, r.Form["tag"])
+	assert.Equal(t, "go", r.FormValue("lang"))
+
+	// Test: Other content types are not parsed
+	r, err = NewReader(strings.NewReader("POST /submit HTTP/1.1\r\nContent-Type: text/plain\r\nContent-Length: 3\r\n\r\na=b")).ReadRequest()
+	require.NoError(t, err)
+	require.ErrorIs(t, r.ParseForm(), ErrNotForm)
+}
+
+func TestMultipart(t *testing.T) {
+	body := "preamble\r\n" +
+		"--XyZ\r\n" +
+		"Content-Disposition: form-data; name=\"title\"\r\n" +
+		"\r\n" +
+		"Holiday\r\n" +
+		"--XyZ\r\n" +
+		"Content-Disposition: form-data; name=\"photo\"; filename=\"../../etc/beach.jpg\"\r\n" +
+		"Content-Type: image/jpeg\r\n" +
+		"\r\n" +
+		strings.Repeat("0123456789", 100) + "\r\n--XyZ-not-a-delimiter" + "\r\n" +
+		"--XyZ\r\n" +
+		"Content-Disposition: form-data; name=\"notes\"; filename=\"notes.txt\"\r\n" +
+		"\r\n" +
+		"short\r\n" +
+		"--XyZ--\r\n"
+	photo := strings.Repeat("0123456789", 100) + "\r\n--XyZ-not-a-delimiter"
+	newRequest := func() *Request {
+		r, err := NewReader(&chunkReader{
+			data: "POST /upload HTTP/1.1\r\n" +
+				"Content-Type: multipart/form-data; boundary=XyZ\r\n" +
+				"Transfer-Encoding: chunked\r\n" +
+				"\r\n" +
+				fmt.Sprintf("%x\r\n%s\r\n0\r\n\r\n", len(body), body),
+			numBytesPerRead: 7,
+		}).ReadRequest()
+		require.NoError(t, err)
+		return r
+	}
+
+	// Test: Streaming the parts
+	mr, err := newRequest().MultipartReader()
+	require.NoError(t, err)
+	part, err := mr.NextPart()
+	require.NoError(t, err)
+	assert.Equal(t, "title", part.Name)
+	assert.Equal(t, "", part.FileName)
+	data, err := io.ReadAll(part)
+	require.NoError(t, err)
+	assert.Equal(t, "Holiday", string(data))
+	part, err = mr.NextPart()
+	require.NoError(t, err)
+	assert.Equal(t, "beach.jpg", part.FileName)
+	contentType, _ := part.Headers.Get("content-type")
+	assert.Equal(t, "image/jpeg", contentType)
+	data, err = io.ReadAll(part)
+	require.NoError(t, err)
+	assert.Equal(t, photo, string(data))
+	// The rest of a part is skipped by NextPart
+	part, err = mr.NextPart()
+	require.NoError(t, err)
+	assert.Equal(t, "notes", part.Name)
+	_, err = mr.NextPart()
+	require.ErrorIs(t, err, io.EOF)
+
+	// Test: Files over the memory threshold spill to disk
+	r := newRequest()
+	require.NoError(t, r.ParseMultipartForm(100))
+	assert.Equal(t, "Holiday", r.FormValue("title"))
+	require.Len(t, r.MultipartForm.File["photo"], 1)
+	fh := r.MultipartForm.File["photo"][0]
+	assert.Equal(t, int64(len(photo)), fh.Size)
+	assert.NotEmpty(t, fh.tmpfile)
+	f, err := fh.Open()
+	require.NoError(t, err)
+	data, err = io.ReadAll(f)
+	require.NoError(t, err)
+	f.Close()
+	assert.Equal(t, photo, string(data))
+	notes := r.MultipartForm.File["notes"][0]
+	assert.Empty(t, notes.tmpfile)
+	f, err = notes.Open()
+	require.NoError(t, err)
+	data, err = io.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, "short", string(data))
+	require.NoError(t, r.MultipartForm.RemoveAll())
+	_, err = os.Stat(fh.tmpfile)
+	assert.True(t, os.IsNotExist(err))
+
+	// Test: Body ending before the closing delimiter
+	mr = NewMultipartReader(strings.NewReader("--XyZ\r\n\r\nunfinished"), "XyZ")
+	part, err = mr.NextPart()
+	require.NoError(t, err)
+	_, err = io.ReadAll(part)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Test: Not multipart
+	r, err = NewReader(strings.NewReader("POST / HTTP/1.1\r\nContent-Type: text/plain\r\n\r\n")).ReadRequest()
+	require.NoError(t, err)
+	_, err = r.MultipartReader()
+	require.ErrorIs(t, err, ErrNotMultipart)
+}
@@ -0,0 +1,244 @@
+package request
+
+import (
+	"httpfromtcp/internal/httperr"
+	"path"
+	"strings"
+)
+
+// TargetForm is the form of a request target (RFC 9112 section 3.2)
+type TargetForm int
+
+const (
+	TargetOrigin    TargetForm = iota // "/path?query"
+	TargetAbsolute                    // "http://host/path?query", sent to proxies
+	TargetAuthority                   // "host:port", only for CONNECT
+	TargetAsterisk                    // "*", only for OPTIONS
+)
+
+// URL is the parsed request target
+type URL struct {
+	Form     TargetForm
+	Scheme   string // absolute-form only
+	Host     string // absolute-form and authority-form
+	Path     string // percent-decoded with dot-segments removed, "*" for asterisk-form
+	RawPath  string // path as sent
+	RawQuery string // query as sent, without "?"
+	Query    Query
+}
+
+// Query holds the decoded query parameters. A name repeated in the query has
+// each of its values in order.
+type Query map[string][]string
+
+// Get returns the first value of key, or "" if there is none
+func (q Query) Get(key string) string {
+	if values := q[key]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// Has reports whether key appears in the query, even without a value
+func (q Query) Has(key string) bool {
+	_, ok := q[key]
+	return ok
+}
+
+// ParseTarget parses a request target sent with method. Errors are
+// *httperr.ParseError with offsets relative to the start of target.
+func ParseTarget(method, target string) (*URL, error) {
+	if i := strings.IndexByte(target, '#'); i != -1 {
+		return nil, httperr.New(httperr.KindBadTarget, i, "fragment not allowed")
+	}
+
+	switch {
+	case target == "*":
+		if method != "OPTIONS" {
+			return nil, httperr.New(httperr.KindBadTarget, 0, "asterisk-form is only allowed with OPTIONS")
+		}
+		return &URL{Form: TargetAsterisk, Path: "*", RawPath: "*", Query: Query{}}, nil
+
+	case method == "CONNECT":
+		// CONNECT names the host and port to tunnel to, and nothing else
+		if !validAuthority(target) {
+			return nil, httperr.New(httperr.KindBadTarget, 0, "CONNECT needs a host:port target: %q", target)
+		}
+		return &URL{Form: TargetAuthority, Host: target, Query: Query{}}, nil
+
+	case strings.HasPrefix(target, "/"):
+		u := &URL{Form: TargetOrigin}
+		if err := u.parsePathQuery(target, 0); err != nil {
+			return nil, err
+		}
+		return u, nil
+	}
+
+	// Anything else must be an absolute URI
+	scheme, rest, ok := strings.Cut(target, "://")
+	if !ok || !validScheme(scheme) {
+		return nil, httperr.New(httperr.KindBadTarget, 0, "expected origin-form or absolute-form: %q", target)
+	}
+	hostEnd := strings.IndexAny(rest, "/?")
+	if hostEnd == -1 {
+		hostEnd = len(rest)
+	}
+	u := &URL{Form: TargetAbsolute, Scheme: strings.ToLower(scheme), Host: rest[:hostEnd]}
+	if u.Host == "" || strings.Contains(u.Host, "@") {
+		return nil, httperr.New(httperr.KindBadTarget, len(scheme)+3, "bad host: %q", u.Host)
+	}
+	// An empty path stands for "/"
+	pathQuery := rest[hostEnd:]
+	pathOffset := len(scheme) + 3 + hostEnd
+	if !strings.HasPrefix(pathQuery, "/") {
+		pathQuery = "/" + pathQuery
+		pathOffset--
+	}
+	if err := u.parsePathQuery(pathQuery, pathOffset); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// Segments returns the path split on "/" into percent-decoded segments,
+// without the leading "/". The raw path is split before decoding, so an
+// encoded "/" stays inside its segment: "/users/a%2Fb" gives "users", "a/b".
+// Dot-segments and empty segments are removed as in Path, and "/" or a
+// trailing "/" gives a last empty segment.
+func (u *URL) Segments() []string {
+	parts := strings.Split(strings.TrimPrefix(u.RawPath, "/"), "/")
+	segments := make([]string, 0, len(parts))
+	for _, part := range parts {
+		segment, err := unescape(part, false)
+		if err != nil {
+			// Only a URL built by hand can get here, ParseTarget checks the path
+			segment = part
+		}
+		switch segment {
+		case "", ".":
+		case "..":
+			if len(segments) > 0 {
+				segments = segments[:len(segments)-1]
+			}
+		default:
+			segments = append(segments, segment)
+		}
+	}
+	if len(segments) == 0 || strings.HasSuffix(u.RawPath, "/") {
+		segments = append(segments, "")
+	}
+	return segments
+}
+
+// parsePathQuery fills in the path and query from s, which starts with "/"
+// and sits at offset in the target
+func (u *URL) parsePathQuery(s string, offset int) error {
+	u.RawPath, u.RawQuery, _ = strings.Cut(s, "?")
+
+	decoded, err := unescape(u.RawPath, false)
+	if err != nil {
+		return offsetBy(err, offset)
+	}
+	// Dot-segments are removed after decoding, so "%2e%2e" can't slip through
+	// and "/a/../b" can't escape a prefix check
+	u.Path = path.Clean(decoded)
+	if strings.HasSuffix(decoded, "/") && u.Path != "/" {
+		u.Path += "/"
+	}
+
+	u.Query, err = parseQuery(u.RawQuery)
+	if err != nil {
+		return offsetBy(err, offset+len(u.RawPath)+1)
+	}
+	return nil
+}
+
+// parseQuery decodes "a=1&b=2&a=3", where "+" stands for a space. Errors
+// have offsets relative to the start of query.
+func parseQuery(query string) (Query, error) {
+	q := Query{}
+	offset := 0
+	for _, pair := range strings.Split(query, "&") {
+		if pair != "" {
+			rawKey, rawValue, _ := strings.Cut(pair, "=")
+			key, err := unescape(rawKey, true)
+			if err != nil {
+				return nil, offsetBy(err, offset)
+			}
+			value, err := unescape(rawValue, true)
+			if err != nil {
+				return nil, offsetBy(err, offset+len(rawKey)+1)
+			}
+			q[key] = append(q[key], value)
+		}
+		offset += len(pair) + 1
+	}
+	return q, nil
+}
+
+// unescape percent-decodes s, and turns "+" into a space in a query. Decoded
+// control characters are rejected.
+func unescape(s string, query bool) (string, error) {
+	if !strings.ContainsAny(s, "%+") {
+		return s, nil
+	}
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '%':
+			if i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2]) {
+				return "", httperr.New(httperr.KindBadTarget, i, "bad percent-encoding")
+			}
+			c = unhex(s[i+1])<<4 | unhex(s[i+2])
+			if c < ' ' || c == 0x7f {
+				return "", httperr.New(httperr.KindBadTarget, i, "encoded control character %q", c)
+			}
+			i += 2
+		case c == '+' && query:
+			c = ' '
+		}
+		b.WriteByte(c)
+	}
+	return b.String(), nil
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
+
+// validScheme reports whether s is a URI scheme: a letter followed by
+// letters, digits, "+", "-" or "."
+func validScheme(s string) bool {
+	if s == "" || !('a' <= s[0]|0x20 && s[0]|0x20 <= 'z') {
+		return false
+	}
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		if !('a' <= c|0x20 && c|0x20 <= 'z' || '0' <= c && c <= '9' || c == '+' || c == '-' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// validAuthority reports whether s looks like "host:port"
+func validAuthority(s string) bool {
+	colon := strings.LastIndexByte(s, ':')
+	if colon <= 0 || colon == len(s)-1 || strings.ContainsAny(s, "/?@") {
+		return false
+	}
+	return strings.Trim(s[colon+1:], "0123456789") == ""
+}
@@ -0,0 +1,102 @@
+package response
+
+import (
+	"httpfromtcp/internal/headers"
+	"sync/atomic"
+	"time"
+)
+
+// TimeFormat is the format of dates in HTTP headers (IMF-fixdate). The time
+// must be in UTC.
+const TimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// Defaults are the headers a Writer adds to every final response. A header
+// the handler sets itself overrides the default, and setting it to an empty
+// value suppresses it.
+type Defaults struct {
+	// OmitDate leaves out the Date header, e.g. for a server without a
+	// reliable clock
+	OmitDate bool
+	// Server is the value of the Server header, none is sent when empty
+	Server string
+	// Headers are added as they are, e.g. security headers. May be nil.
+	Headers *headers.Headers
+}
+
+// apply adds the defaults missing from h and drops the ones set to an empty
+// value
+func (d Defaults) apply(h *headers.Headers) {
+	if d.Headers != nil {
+		own := h.Clone()
+		for _, f := range d.Headers.Fields() {
+			if _, ok := own.Get(f.Name); !ok {
+				h.Add(f.Name, f.Value)
+			}
+		}
+		dropEmpty(h, d.Headers)
+	}
+	date := ""
+	if !d.OmitDate {
+		date = currentDate()
+	}
+	addDefault(h, "Date", date)
+	addDefault(h, "Server", d.Server)
+}
+
+func addDefault(h *headers.Headers, name, value string) {
+	if v, ok := h.Get(name); ok {
+		if v == "" {
+			h.Del(name)
+		}
+		return
+	}
+	if value != "" {
+		h.Add(name, value)
+	}
+}
+
+// dropEmpty removes the headers of defaults that h sets to an empty value
+func dropEmpty(h, defaults *headers.Headers) {
+	for _, f := range defaults.Fields() {
+		if v, ok := h.Get(f.Name); ok && v == "" {
+			h.Del(f.Name)
+		}
+	}
+}
+
+// FormatDate formats t for an HTTP header
+func FormatDate(t time.Time) string {
+	return t.UTC().Format(TimeFormat)
+}
+
+// ParseDate parses a date from an HTTP header. Besides IMF-fixdate it accepts
+// the obsolete RFC 850 and asctime formats recipients must still understand.
+func ParseDate(value string) (time.Time, error) {
+	var err error
+	for _, layout := range []string{TimeFormat, "Monday, 02-Jan-06 15:04:05 GMT", "Mon Jan _2 15:04:05 2006"} {
+		var t time.Time
+		if t, err = time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+type cachedDate struct {
+	unix  int64
+	value string
+}
+
+var dateCache atomic.Pointer[cachedDate]
+
+// currentDate returns the Date header value for now. It only changes once a
+// second, so it's formatted once a second and shared by all connections.
+func currentDate() string {
+	now := time.Now()
+	if c := dateCache.Load(); c != nil && c.unix == now.Unix() {
+		return c.value
+	}
+	c := &cachedDate{unix: now.Unix(), value: FormatDate(now)}
+	dateCache.Store(c)
+	return c.value
+}
@@ -1,20 +1,12 @@
 package response
 
 import (
+	"errors"
 	"fmt"
-	"html/template"
 	"httpfromtcp/internal/headers"
 	"io"
-	"net/http"
 	"strconv"
-)
-
-type StatusCode int
-
-const (
-	StatusOK                  StatusCode = 200
-	StatusBadRequest          StatusCode = 400
-	StatusInternalServerError StatusCode = 500
+	"strings"
 )
 
 const (
@@ -24,101 +16,253 @@ const (
 	WriterStateTrailers
 )
 
-// Define the template structure for dynamic content
-const tmpl = `<html>
-	<head>
-		<title>{{.Title}}</title>
-	</head>
-	<body>
-		<h1>{{.Heading}}</h1>
-		<p>{{.Message}}</p>
-	</body>
-</html>`
+type Writer struct {
+	conn           io.Writer
+	writerState    int
+	keepAlive      bool
+	keepAliveCheck func() bool // asked when the final headers are written
+	http10         bool        // the client speaks HTTP/1.0 and can't decode chunks
+	wroteHeaders   bool
+	chunked        bool
+	unframed       bool // chunked body sent as is, ended by closing the connection
+	noBody         bool // the status code doesn't allow a body
+	discardBody    bool // the request was HEAD, headers only
+	statusCode     StatusCode
+	contentLength  int64 // declared Content-Length, -1 if none
+	bytesWritten   int64
+	defaults       Defaults
+}
 
-const lenTmpl = len(tmpl) - len("{{.Title}}") - len("{{.Heading}}") - len("{{.Message}}")
+var (
+	ErrBodyTooLong    = errors.New("response: body longer than the declared Content-Length")
+	ErrBodyTooShort   = errors.New("response: body shorter than the declared Content-Length")
+	ErrBodyNotAllowed = errors.New("response: status code does not allow a body")
+	// Reported by Finish when the handler wrote no final response, an empty
+	// 200 OK was sent in its place
+	ErrNoResponse = errors.New("response: no response written, sent an empty 200 OK")
+	// Reported by Finish when the handler wrote a status line but no headers,
+	// they were completed with an empty body and the connection can't be reused
+	ErrIncompleteResponse = errors.New("response: status line written without headers")
+)
 
-// Struct to hold data for dynamic population
-type PageData struct {
-	Title   string
-	Heading string
-	Message string
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{
+		conn:          w,
+		writerState:   WriterStateStatusLine,
+		contentLength: -1,
+	}
 }
 
-func (p *PageData) ContentLength() int {
-	return lenTmpl + len(p.Title) + len(p.Heading) + len(p.Message)
+// SetKeepAlive tells the writer whether the connection may stay open after
+// this response. It decides the Connection header written by WriteHeaders.
+func (w *Writer) SetKeepAlive(keepAlive bool) {
+	w.keepAlive = keepAlive
 }
 
-type Writer struct {
-	io.Writer
-	writerState int
+// SetKeepAliveCheck sets a function asked, when the final headers are
+// written, whether the connection can still be kept alive. The server uses it
+// to close connections it would have to read too much unread request body
+// from, before the response says otherwise.
+func (w *Writer) SetKeepAliveCheck(check func() bool) {
+	w.keepAliveCheck = check
 }
 
-func NewWriter(w io.Writer) *Writer {
-	return &Writer{
-		Writer:      w,
-		writerState: WriterStateStatusLine,
+// SetDefaults sets the headers added to every final response. Without it
+// only Date is added.
+func (w *Writer) SetDefaults(defaults Defaults) {
+	w.defaults = defaults
+}
+
+// SetHTTP10 tells the writer the client speaks HTTP/1.0. A chunked response
+// is then sent without chunk framing or trailers and ends by closing the
+// connection.
+func (w *Writer) SetHTTP10(http10 bool) {
+	w.http10 = http10
+}
+
+// SetDiscardBody makes the writer send the status line and headers but drop
+// the body, chunk framing and trailers, as the answer to a HEAD request. A
+// handler can then write the same response as for GET, and its headers,
+// Content-Length included, describe the body that would have been sent.
+func (w *Writer) SetDiscardBody(discard bool) {
+	w.discardBody = discard
+}
+
+// KeepAlive reports whether the connection can be reused for another request:
+// keep-alive must be allowed, the headers must have been written and the body
+// must be delimited so the client knows where the response ends.
+func (w *Writer) KeepAlive() bool {
+	if !w.keepAlive || !w.wroteHeaders {
+		return false
+	}
+	// A chunked body that was never terminated leaves the stream unusable
+	if w.chunked && (w.writerState == WriterStateBody || w.writerState == WriterStateTrailers) {
+		return false
+	}
+	// So does a body shorter than its Content-Length
+	return w.noBody || w.discardBody || w.contentLength < 0 || w.bytesWritten >= w.contentLength
+}
+
+// Write streams body bytes once the headers are written. With chunked
+// encoding each call sends one chunk. Writing past the declared
+// Content-Length is refused with ErrBodyTooLong. Only body bytes count
+// towards BytesWritten, the status line, headers and chunk framing don't.
+// With SetDiscardBody the bytes are accepted and dropped, and don't count.
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.writerState != WriterStateBody {
+		return 0, fmt.Errorf("incorrect writer state, should write headers before the body")
 	}
+	if w.chunked {
+		if _, err := w.WriteChunkedBody(p); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	return w.writeBody(p)
+}
+
+// writeBody writes body bytes without chunk framing
+func (w *Writer) writeBody(p []byte) (int, error) {
+	if w.noBody && len(p) > 0 {
+		return 0, ErrBodyNotAllowed
+	}
+	if w.discardBody {
+		return len(p), nil
+	}
+	if w.contentLength >= 0 && w.bytesWritten+int64(len(p)) > w.contentLength {
+		return 0, ErrBodyTooLong
+	}
+	n, err := w.conn.Write(p)
+	w.bytesWritten += int64(n)
+	return n, err
+}
+
+// StatusCode returns the status code written by WriteStatusLine, or 0 if none
+// was written yet. Middleware can read it after the inner handler returns.
+func (w *Writer) StatusCode() StatusCode {
+	return w.statusCode
+}
+
+// BytesWritten returns the number of body bytes written so far
+func (w *Writer) BytesWritten() int64 {
+	return w.bytesWritten
 }
 
+// WriteStatusLine writes the status line with the registered reason phrase
 func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
+	return w.WriteStatusLineReason(statusCode, ReasonPhrase(statusCode))
+}
+
+// WriteStatusLineReason writes the status line with a custom reason phrase,
+// which may be empty
+func (w *Writer) WriteStatusLineReason(statusCode StatusCode, reasonPhrase string) error {
 	// Check if the writer is in the correct state
 	if w.writerState != WriterStateStatusLine {
 		return fmt.Errorf("incorrect writer state, should write status line first")
 	}
-
-	// Write the status line
-	var reasonPhrase string
-	if statusCode == StatusOK || statusCode == StatusBadRequest || statusCode == StatusInternalServerError {
-		reasonPhrase = http.StatusText(int(statusCode))
-	} else {
-		reasonPhrase = "" //TODO: MAY NEED TO CHANGE TO SPACE to follow the HTTP spec
+	if statusCode < 100 || statusCode > 999 {
+		return fmt.Errorf("invalid status code %d", statusCode)
+	}
+	if i := strings.IndexFunc(reasonPhrase, func(r rune) bool { return r < ' ' && r != '\t' || r == 0x7f }); i != -1 {
+		return fmt.Errorf("invalid character %q in reason phrase", reasonPhrase[i])
 	}
 
-	_, err := fmt.Fprintf(w, "HTTP/1.1 %d %s\r\n", statusCode, reasonPhrase)
+	// Write the status line, the space before the reason is required even if it's empty
+	_, err := fmt.Fprintf(w.conn, "HTTP/1.1 %d %s\r\n", statusCode, reasonPhrase)
 	if err == nil {
 		// Set the writer state to headers after writing the status line
 		w.writerState = WriterStateHeaders
+		w.statusCode = statusCode
 	}
 	return err
 }
 
-func (w *Writer) WriteHeaders(headers headers.Headers) error {
+func (w *Writer) WriteHeaders(headers *headers.Headers) error {
 	// Check if the writer is in the correct state
 	if w.writerState != WriterStateHeaders {
 		return fmt.Errorf("incorrect writer state, should write headers second")
 	}
 
-	// Write the headers
-	for key, value := range headers {
-		if _, err := fmt.Fprintf(w, "%s: %s\r\n", key, value); err != nil {
-			return err
+	// Final responses get the default headers the handler didn't set
+	out := headers.Clone()
+	interim := w.statusCode < 200 && w.statusCode != StatusSwitchingProtocols
+	if !interim {
+		w.defaults.apply(out)
+	}
+	// 1xx, 204 and 304 responses end with the headers, 1xx and 204 can't even
+	// claim a length. A 304 may give the length of the unmodified content.
+	w.noBody = !BodyAllowed(w.statusCode)
+	if w.noBody {
+		out.Del("Transfer-Encoding")
+		out.Del("Trailer")
+		if w.statusCode < 200 || w.statusCode == StatusNoContent {
+			out.Del("Content-Length")
 		}
 	}
-	_, err := fmt.Fprint(w, "\r\n")
+
+	// The connection can only be kept alive if the client can find the end of the body
+	_, hasContentLength := out.Get("Content-Length")
+	w.chunked = out.HasToken("Transfer-Encoding", "chunked")
+	if w.chunked && w.http10 {
+		w.chunked = false
+		w.unframed = true
+		out.Del("Transfer-Encoding")
+		out.Del("Trailer")
+	}
+	if !hasContentLength && !w.chunked && !w.noBody && !w.discardBody {
+		w.keepAlive = false
+	}
+	// Body writes are checked against the declared length
+	w.contentLength = -1
+	if contentLength, ok := out.Get("Content-Length"); ok && !w.chunked && !w.unframed && !w.noBody {
+		n, err := strconv.ParseInt(contentLength, 10, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid Content-Length %q", contentLength)
+		}
+		w.contentLength = n
+	}
+	// A handler can still ask for the connection to be closed
+	if headers.HasToken("Connection", "close") {
+		w.keepAlive = false
+	}
+	if w.keepAlive && !interim && w.keepAliveCheck != nil && !w.keepAliveCheck() {
+		w.keepAlive = false
+	}
+
+	// Write the headers, the Connection header is managed by the writer and
+	// left to the final response
+	out.Del("Connection")
+	if !interim {
+		connection := "close"
+		if w.keepAlive {
+			connection = "keep-alive"
+		}
+		out.Add("Connection", connection)
+	}
+	if err := out.Write(w.conn); err != nil {
+		return err
+	}
+	_, err := fmt.Fprint(w.conn, "\r\n")
+	if err == nil && interim {
+		// The final response follows an interim one
+		w.writerState = WriterStateStatusLine
+		return nil
+	}
 	if err == nil {
 		// Set the writer state to body after writing the headers
 		w.writerState = WriterStateBody
+		w.wroteHeaders = true
 	}
 	return err
 }
 
-func (w *Writer) WriteBody(data PageData) error {
-	// Check if the writer is in the correct state
-	if w.writerState != WriterStateBody {
-		return fmt.Errorf("incorrect writer state, should write body last")
-	}
-
-	// Create a new template and parse it
-	t, err := template.New("webpage").Parse(tmpl)
-	if err != nil {
+// WriteBody writes p as the whole body and ends the response. With a
+// Content-Length, p must be exactly that long.
+func (w *Writer) WriteBody(p []byte) error {
+	if _, err := w.Write(p); err != nil {
 		return err
 	}
-
-	// Reset the writer state to status line after writing the body
-	w.writerState = WriterStateStatusLine
-
-	// Write the populated template to the custom writer (e.g., http.ResponseWriter)
-	return t.Execute(w, data)
+	return w.Finish()
 }
 
 func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
@@ -127,16 +271,25 @@ func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
 		return 0, fmt.Errorf("incorrect writer state, should write body third")
 	}
 
+	// An HTTP/1.0 client gets the data without framing, a HEAD request none
+	if w.unframed || w.discardBody {
+		return w.writeBody(p)
+	}
+	// An empty chunk would end the body
+	if len(p) == 0 {
+		return 0, nil
+	}
+
 	// Write the chunked body
-	n, err := fmt.Fprintf(w, "%x\r\n", len(p))
+	n, err := fmt.Fprintf(w.conn, "%x\r\n", len(p))
 	if err != nil {
 		return n, err
 	}
-	n2, err := w.Write(p)
+	n2, err := w.writeBody(p)
 	if err != nil {
 		return n + n2, err
 	}
-	n3, err := fmt.Fprint(w, "\r\n")
+	n3, err := fmt.Fprint(w.conn, "\r\n")
 	return n + n2 + n3, err
 }
 
@@ -146,8 +299,12 @@ func (w *Writer) WriteChunkedBodyDone() (int, error) {
 		return 0, fmt.Errorf("incorrect writer state, should write body third")
 	}
 
-	// Write the chunked body done
-	n, err := fmt.Fprint(w, "0\r\n\r\n")
+	// Write the last chunk, the trailer section follows it
+	if w.unframed || w.discardBody {
+		w.writerState = WriterStateTrailers
+		return 0, nil
+	}
+	n, err := fmt.Fprint(w.conn, "0\r\n")
 	if err == nil {
 		// Set the writer state to trailers after writing the chunked body
 		w.writerState = WriterStateTrailers
@@ -155,19 +312,86 @@ func (w *Writer) WriteChunkedBodyDone() (int, error) {
 	return n, err
 }
 
-func (w *Writer) WriteTrailers(h headers.Headers) error {
+// Finish ends the response once the handler is done with it. A chunked body
+// gets its last chunk and an empty trailer section if those were not
+// written, and a body shorter than its Content-Length is reported with
+// ErrBodyTooShort, in which case the connection can't be reused. A handler
+// that wrote nothing, or only a status line, still leaves the client with a
+// complete response: see ErrNoResponse and ErrIncompleteResponse.
+func (w *Writer) Finish() error {
+	switch w.writerState {
+	case WriterStateStatusLine:
+		if w.wroteHeaders {
+			return nil
+		}
+		if err := w.WriteStatusLine(StatusOK); err != nil {
+			return err
+		}
+		if err := w.finishHeaders(); err != nil {
+			return err
+		}
+		return ErrNoResponse
+	case WriterStateHeaders:
+		w.keepAlive = false
+		if err := w.finishHeaders(); err != nil {
+			return err
+		}
+		// An interim response still needs a final one
+		if !w.wroteHeaders {
+			if err := w.Finish(); !errors.Is(err, ErrNoResponse) {
+				return err
+			}
+		}
+		return ErrIncompleteResponse
+	case WriterStateBody:
+		if w.chunked || w.unframed {
+			if _, err := w.WriteChunkedBodyDone(); err != nil {
+				return err
+			}
+			return w.WriteTrailers(headers.NewHeaders())
+		}
+		if w.contentLength >= 0 && w.bytesWritten < w.contentLength && !w.discardBody {
+			return ErrBodyTooShort
+		}
+		// Reset the writer state to status line after writing the body
+		w.writerState = WriterStateStatusLine
+	case WriterStateTrailers:
+		return w.WriteTrailers(headers.NewHeaders())
+	}
+	return nil
+}
+
+// finishHeaders writes the headers of a response the handler left without a
+// body
+func (w *Writer) finishHeaders() error {
+	h := headers.NewHeaders()
+	h.Set("Content-Length", "0")
+	if err := w.WriteHeaders(h); err != nil {
+		return err
+	}
+	if w.writerState == WriterStateBody {
+		w.writerState = WriterStateStatusLine
+	}
+	return nil
+}
+
+func (w *Writer) WriteTrailers(h *headers.Headers) error {
 	// Check if the writer is in the correct state
 	if w.writerState != WriterStateTrailers {
 		return fmt.Errorf("incorrect writer state, should write trailers last")
 	}
 
-	// Write the headers
-	for key, value := range h {
-		if _, err := fmt.Fprintf(w, "%s: %s\r\n", key, value); err != nil {
-			return err
-		}
+	// Trailers can't be sent without chunked encoding, nor after no body
+	if w.unframed || w.discardBody {
+		w.writerState = WriterStateStatusLine
+		return nil
 	}
-	_, err := fmt.Fprint(w, "\r\n")
+
+	// Write the trailer fields and the empty line ending the message
+	if err := h.Write(w.conn); err != nil {
+		return err
+	}
+	_, err := fmt.Fprint(w.conn, "\r\n")
 	if err == nil {
 		// Set the writer state to status line after writing the trailers
 		w.writerState = WriterStateStatusLine
@@ -175,10 +399,11 @@ func (w *Writer) WriteTrailers(h headers.Headers) error {
 	return err
 }
 
-func GetDefaultHeaders(contentLen int) headers.Headers {
-	return headers.Headers{
-		"Content-Length": strconv.Itoa(contentLen), // fmt.Sprintf("%d", contentLen) is generally prefered but strconv.Itoa is faster
-		"Content-Type":   "text/html",
-		"Connection":     "close",
-	}
+// GetDefaultHeaders returns the headers of an HTML body of contentLen bytes.
+// Date, Server and Connection are added by the Writer.
+func GetDefaultHeaders(contentLen int) *headers.Headers {
+	h := headers.NewHeaders()
+	h.Set("Content-Length", strconv.Itoa(contentLen)) // fmt.Sprintf("%d", contentLen) is generally prefered but strconv.Itoa is faster
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	return h
 }
@@ -0,0 +1,326 @@
+package response
+
+import (
+	"bytes"
+	"httpfromtcp/internal/headers"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestWriter returns a keep-alive Writer without the Date header, so
+// whole responses can be compared
+func newTestWriter() (*Writer, *bytes.Buffer) {
+	out := &bytes.Buffer{}
+	w := NewWriter(out)
+	w.SetKeepAlive(true)
+	w.SetDefaults(Defaults{OmitDate: true})
+	return w, out
+}
+
+func TestWriteBody(t *testing.T) {
+	newWriter := func(h *headers.Headers) (*Writer, *bytes.Buffer) {
+		w, out := newTestWriter()
+		require.NoError(t, w.WriteStatusLine(StatusOK))
+		require.NoError(t, w.WriteHeaders(h))
+		return w, out
+	}
+	fixed := func(n string) *headers.Headers {
+		h := headers.NewHeaders()
+		h.Set("Content-Length", n)
+		return h
+	}
+
+	// Test: Body matching the Content-Length
+	w, out := newWriter(fixed("5"))
+	require.NoError(t, w.WriteBody([]byte("hello")))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\nConnection: keep-alive\r\n\r\nhello", out.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Streaming past the Content-Length is refused
+	w, out = newWriter(fixed("5"))
+	n, err := w.Write([]byte("hel"))
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+	_, err = w.Write([]byte("lo!"))
+	require.ErrorIs(t, err, ErrBodyTooLong)
+	assert.Equal(t, int64(3), w.BytesWritten())
+
+	// Test: Stopping short of the Content-Length
+	require.ErrorIs(t, w.Finish(), ErrBodyTooShort)
+	assert.False(t, w.KeepAlive())
+
+	// Test: Chunked writes are framed and finished
+	h := headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	w, out = newWriter(h)
+	_, err = w.Write([]byte("hello"))
+	require.NoError(t, err)
+	_, err = w.Write(nil)
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nConnection: keep-alive\r\n\r\n5\r\nhello\r\n0\r\n\r\n", out.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Body before the headers
+	w = NewWriter(&bytes.Buffer{})
+	_, err = w.Write([]byte("hello"))
+	require.Error(t, err)
+
+	// Test: The keep-alive check is asked when the headers are written
+	w, out = newTestWriter()
+	w.SetKeepAliveCheck(func() bool { return false })
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(fixed("0")))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", out.String())
+	assert.False(t, w.KeepAlive())
+
+	// Test: Nil headers are written as none
+	w, out = newTestWriter()
+	require.NoError(t, w.WriteStatusLine(StatusNoContent))
+	require.NoError(t, w.WriteHeaders(nil))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 204 No Content\r\nConnection: keep-alive\r\n\r\n", out.String())
+
+	// Test: Nothing written gets an empty 200 that keeps the connection
+	w, out = newTestWriter()
+	require.ErrorIs(t, w.Finish(), ErrNoResponse)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\nConnection: keep-alive\r\n\r\n", out.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: A status line alone is completed and closes the connection
+	w, out = newTestWriter()
+	require.NoError(t, w.WriteStatusLine(StatusNotFound))
+	require.ErrorIs(t, w.Finish(), ErrIncompleteResponse)
+	assert.Equal(t, "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", out.String())
+	assert.False(t, w.KeepAlive())
+
+	// Test: An interim status line alone is followed by a final response
+	w, out = newTestWriter()
+	require.NoError(t, w.WriteStatusLine(StatusEarlyHints))
+	require.ErrorIs(t, w.Finish(), ErrIncompleteResponse)
+	assert.Equal(t, "HTTP/1.1 103 Early Hints\r\n\r\nHTTP/1.1 200 OK\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", out.String())
+	assert.False(t, w.KeepAlive())
+}
+
+func TestResponseWriter(t *testing.T) {
+	newResponseWriter := func() (*ResponseWriter, *bytes.Buffer) {
+		w, out := newTestWriter()
+		return NewResponseWriter(w), out
+	}
+
+	// Test: Small body gets a Content-Length and an implicit 200
+	rw, out := newResponseWriter()
+	rw.Header().Set("Content-Type", "text/plain")
+	rw.Write([]byte("hello "))
+	rw.Write([]byte("world"))
+	require.NoError(t, rw.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 11\r\nConnection: keep-alive\r\n\r\nhello world", out.String())
+
+	// Test: Only the first WriteHeader counts, an empty body still gets a length
+	rw, out = newResponseWriter()
+	rw.WriteHeader(StatusNotFound)
+	rw.WriteHeader(StatusInternalServerError)
+	require.NoError(t, rw.Finish())
+	assert.Equal(t, "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\nConnection: keep-alive\r\n\r\n", out.String())
+
+	// Test: Body past the buffer switches to chunked encoding
+	rw, out = newResponseWriter()
+	big := strings.Repeat("a", responseBufferSize)
+	rw.Write([]byte("first"))
+	assert.Equal(t, 0, out.Len())
+	rw.Write([]byte(big))
+	require.NoError(t, rw.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nConnection: keep-alive\r\n\r\n"+
+		"5\r\nfirst\r\n1000\r\n"+big+"\r\n0\r\n\r\n", out.String())
+
+	// Test: Declared Content-Length is streamed straight through
+	rw, out = newResponseWriter()
+	rw.Header().Set("Content-Length", "5")
+	rw.Write([]byte("hel"))
+	assert.Contains(t, out.String(), "\r\n\r\nhel")
+	rw.Write([]byte("lo"))
+	require.NoError(t, rw.Finish())
+	assert.True(t, strings.HasSuffix(out.String(), "\r\n\r\nhello"))
+
+	// Test: Declared trailers make the body chunked
+	rw, out = newResponseWriter()
+	rw.Header().Set("Trailer", "X-Sum")
+	rw.Write([]byte("hi"))
+	rw.Trailer().Set("X-Sum", "42")
+	require.NoError(t, rw.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTrailer: X-Sum\r\nTransfer-Encoding: chunked\r\nConnection: keep-alive\r\n\r\n"+
+		"2\r\nhi\r\n0\r\nX-Sum: 42\r\n\r\n", out.String())
+}
+
+func TestStatusLine(t *testing.T) {
+	// Test: Registered and unregistered reason phrases
+	assert.Equal(t, "Too Many Requests", ReasonPhrase(StatusTooManyRequests))
+	assert.Equal(t, "Early Hints", ReasonPhrase(StatusEarlyHints))
+	assert.Equal(t, "", ReasonPhrase(599))
+
+	out := &bytes.Buffer{}
+	w := NewWriter(out)
+	require.NoError(t, w.WriteStatusLine(599))
+	assert.Equal(t, "HTTP/1.1 599 \r\n", out.String())
+
+	// Test: Custom reason phrase
+	out = &bytes.Buffer{}
+	w = NewWriter(out)
+	require.NoError(t, w.WriteStatusLineReason(StatusOK, "Fine"))
+	assert.Equal(t, "HTTP/1.1 200 Fine\r\n", out.String())
+
+	// Test: Invalid status code and reason phrase
+	w = NewWriter(&bytes.Buffer{})
+	require.Error(t, w.WriteStatusLine(42))
+	require.Error(t, w.WriteStatusLineReason(StatusOK, "O\r\nK"))
+
+	// Test: 204 drops its framing headers and refuses a body
+	w, out = newTestWriter()
+	h := headers.NewHeaders()
+	h.Set("Content-Length", "5")
+	h.Set("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteStatusLine(StatusNoContent))
+	require.NoError(t, w.WriteHeaders(h))
+	_, err := w.Write([]byte("hello"))
+	require.ErrorIs(t, err, ErrBodyNotAllowed)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 204 No Content\r\nConnection: keep-alive\r\n\r\n", out.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: 304 keeps the length of the unmodified content
+	w, out = newTestWriter()
+	require.NoError(t, w.WriteStatusLine(StatusNotModified))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(12)))
+	require.NoError(t, w.Finish())
+	assert.Contains(t, out.String(), "Content-Length: 12\r\n")
+	assert.True(t, w.KeepAlive())
+
+	// Test: Interim response before the final one
+	w, out = newTestWriter()
+	h = headers.NewHeaders()
+	h.Set("Link", "</style.css>; rel=preload")
+	require.NoError(t, w.WriteStatusLine(StatusEarlyHints))
+	require.NoError(t, w.WriteHeaders(h))
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(2)))
+	require.NoError(t, w.WriteBody([]byte("hi")))
+	assert.True(t, strings.HasPrefix(out.String(), "HTTP/1.1 103 Early Hints\r\nLink: </style.css>; rel=preload\r\n\r\nHTTP/1.1 200 OK\r\n"))
+	assert.Equal(t, StatusOK, w.StatusCode())
+
+	// Test: ResponseWriter sends no framing for a 204
+	w, out = newTestWriter()
+	rw := NewResponseWriter(w)
+	rw.WriteHeader(StatusNoContent)
+	_, err = rw.Write([]byte("x"))
+	require.ErrorIs(t, err, ErrBodyNotAllowed)
+	require.NoError(t, rw.Finish())
+	assert.Equal(t, "HTTP/1.1 204 No Content\r\nConnection: keep-alive\r\n\r\n", out.String())
+}
+
+func TestDefaults(t *testing.T) {
+	writeHead := func(defaults Defaults, h *headers.Headers) string {
+		out := &bytes.Buffer{}
+		w := NewWriter(out)
+		w.SetDefaults(defaults)
+		require.NoError(t, w.WriteStatusLine(StatusOK))
+		require.NoError(t, w.WriteHeaders(h))
+		return out.String()
+	}
+
+	// Test: Date is sent by default, in IMF-fixdate
+	head := writeHead(Defaults{}, GetDefaultHeaders(0))
+	assert.Contains(t, head, "Content-Type: text/html; charset=utf-8\r\n")
+	date, _, ok := strings.Cut(head[strings.Index(head, "Date: ")+len("Date: "):], "\r\n")
+	require.True(t, ok)
+	_, err := time.Parse(TimeFormat, date)
+	require.NoError(t, err)
+	assert.NotContains(t, head, "Server:")
+
+	// Test: Server and extra headers
+	extra := headers.NewHeaders()
+	extra.Set("X-Content-Type-Options", "nosniff")
+	head = writeHead(Defaults{Server: "httpfromtcp", Headers: extra}, headers.NewHeaders())
+	assert.Contains(t, head, "Server: httpfromtcp\r\n")
+	assert.Contains(t, head, "X-Content-Type-Options: nosniff\r\n")
+
+	// Test: Handler headers override or suppress the defaults
+	h := headers.NewHeaders()
+	h.Set("Server", "custom")
+	h.Set("Date", "")
+	h.Set("X-Content-Type-Options", "")
+	head = writeHead(Defaults{Server: "httpfromtcp", Headers: extra}, h)
+	assert.Contains(t, head, "Server: custom\r\n")
+	assert.NotContains(t, head, "Server: httpfromtcp")
+	assert.NotContains(t, head, "Date:")
+	assert.NotContains(t, head, "X-Content-Type-Options")
+
+	// Test: Interim responses get no defaults
+	out := &bytes.Buffer{}
+	w := NewWriter(out)
+	w.SetDefaults(Defaults{Server: "httpfromtcp"})
+	require.NoError(t, w.WriteStatusLine(StatusContinue))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	assert.Equal(t, "HTTP/1.1 100 Continue\r\n\r\n", out.String())
+
+	// Test: Dates in the current and obsolete formats
+	want := time.Date(1994, 11, 6, 8, 49, 37, 0, time.UTC)
+	for _, value := range []string{"Sun, 06 Nov 1994 08:49:37 GMT", "Sunday, 06-Nov-94 08:49:37 GMT", "Sun Nov  6 08:49:37 1994"} {
+		got, err := ParseDate(value)
+		require.NoError(t, err, value)
+		assert.True(t, want.Equal(got), value)
+	}
+	_, err = ParseDate("yesterday")
+	require.Error(t, err)
+}
+
+func TestDiscardBody(t *testing.T) {
+	newWriter := func() (*Writer, *bytes.Buffer) {
+		w, out := newTestWriter()
+		w.SetDiscardBody(true)
+		return w, out
+	}
+
+	// Test: Content-Length is kept, the body dropped
+	w, out := newWriter()
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+	require.NoError(t, w.WriteBody([]byte("hello")))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\nContent-Type: text/html; charset=utf-8\r\nConnection: keep-alive\r\n\r\n", out.String())
+	assert.Equal(t, int64(0), w.BytesWritten())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Headers only is not a short body
+	w, _ = newWriter()
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+	require.NoError(t, w.Finish())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Chunks, last chunk and trailers are dropped
+	w, out = newWriter()
+	h := headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Trailer", "X-Sum")
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(h))
+	_, err := w.Write([]byte("hello"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Sum", "42")
+	require.NoError(t, w.WriteTrailers(trailers))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nTrailer: X-Sum\r\nConnection: keep-alive\r\n\r\n", out.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: ResponseWriter still computes the Content-Length
+	w, out = newWriter()
+	rw := NewResponseWriter(w)
+	rw.Write([]byte("hello world"))
+	require.NoError(t, rw.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 11\r\nConnection: keep-alive\r\n\r\n", out.String())
+}
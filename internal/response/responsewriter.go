@@ -0,0 +1,146 @@
+package response
+
+import (
+	"httpfromtcp/internal/headers"
+	"strconv"
+)
+
+// responseBufferSize is how much body a ResponseWriter holds back to send it
+// with a Content-Length before switching to chunked encoding
+const responseBufferSize = 4 * 1024
+
+// ResponseWriter is a net/http-style writer over a Writer. Handlers set
+// headers with Header, the status with WriteHeader and stream the body with
+// Write, without working out the framing themselves:
+//   - a body that fits in the buffer is sent with a Content-Length
+//   - a larger one switches to chunked encoding once the buffer overflows
+//   - a Content-Length or Transfer-Encoding set by the handler is honored,
+//     and declaring a Trailer header always selects chunked encoding
+//
+// The first Write sends an implicit 200 OK if WriteHeader wasn't called.
+type ResponseWriter struct {
+	w           *Writer
+	header      *headers.Headers
+	trailer     *headers.Headers
+	statusCode  StatusCode
+	wroteHeader bool // WriteHeader called, explicitly or by Write
+	committed   bool // status line and headers sent
+	buf         []byte
+}
+
+func NewResponseWriter(w *Writer) *ResponseWriter {
+	return &ResponseWriter{
+		w:       w,
+		header:  headers.NewHeaders(),
+		trailer: headers.NewHeaders(),
+	}
+}
+
+// Header returns the headers to send. Changes after the headers were sent,
+// by the first Write past the buffer, Flush or Finish, have no effect.
+func (rw *ResponseWriter) Header() *headers.Headers {
+	return rw.header
+}
+
+// Trailer returns the trailer fields sent after a chunked body. They can be
+// set until Finish. Declare them in a Trailer header before the first Write.
+func (rw *ResponseWriter) Trailer() *headers.Headers {
+	return rw.trailer
+}
+
+// WriteHeader sets the status code. Only the first call counts.
+func (rw *ResponseWriter) WriteHeader(statusCode StatusCode) {
+	if rw.wroteHeader {
+		return
+	}
+	rw.wroteHeader = true
+	rw.statusCode = statusCode
+}
+
+// Write buffers or sends body bytes, sending 200 OK first if no status was set
+func (rw *ResponseWriter) Write(p []byte) (int, error) {
+	rw.WriteHeader(StatusOK)
+	if !BodyAllowed(rw.statusCode) && len(p) > 0 {
+		return 0, ErrBodyNotAllowed
+	}
+
+	// A declared length is streamed straight through
+	if !rw.committed {
+		if _, ok := rw.header.Get("Content-Length"); ok {
+			if err := rw.commit(false); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if rw.committed {
+		return rw.w.Write(p)
+	}
+
+	if len(rw.buf)+len(p) <= responseBufferSize {
+		rw.buf = append(rw.buf, p...)
+		return len(p), nil
+	}
+	// Too big to buffer, go chunked with what was buffered as the first chunk
+	if err := rw.commit(false); err != nil {
+		return 0, err
+	}
+	return rw.w.Write(p)
+}
+
+// Flush sends the headers and the buffered body now, switching to chunked
+// encoding unless a Content-Length was set
+func (rw *ResponseWriter) Flush() error {
+	rw.WriteHeader(StatusOK)
+	if rw.committed {
+		return nil
+	}
+	return rw.commit(false)
+}
+
+// Finish sends whatever is still buffered and ends the response. With
+// nothing sent yet the whole body is known, so it gets a Content-Length.
+func (rw *ResponseWriter) Finish() error {
+	rw.WriteHeader(StatusOK)
+	if !rw.committed {
+		if err := rw.commit(true); err != nil {
+			return err
+		}
+	}
+	if rw.w.chunked && rw.w.writerState == WriterStateBody {
+		if _, err := rw.w.WriteChunkedBodyDone(); err != nil {
+			return err
+		}
+		return rw.w.WriteTrailers(rw.trailer)
+	}
+	return rw.w.Finish()
+}
+
+// commit sends the status line, the headers and the buffered body. final
+// tells whether the buffer holds the whole body.
+func (rw *ResponseWriter) commit(final bool) error {
+	h := rw.header.Clone()
+	_, hasContentLength := h.Get("Content-Length")
+	_, hasTrailer := h.Get("Trailer")
+	if !hasContentLength && !h.HasToken("Transfer-Encoding", "chunked") && BodyAllowed(rw.statusCode) {
+		if final && !hasTrailer {
+			h.Set("Content-Length", strconv.Itoa(len(rw.buf)))
+		} else {
+			h.Set("Transfer-Encoding", "chunked")
+		}
+	}
+
+	rw.committed = true
+	if err := rw.w.WriteStatusLine(rw.statusCode); err != nil {
+		return err
+	}
+	if err := rw.w.WriteHeaders(h); err != nil {
+		return err
+	}
+	buf := rw.buf
+	rw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	_, err := rw.w.Write(buf)
+	return err
+}
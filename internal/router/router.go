@@ -0,0 +1,227 @@
+package router
+
+import (
+	"fmt"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"httpfromtcp/internal/templates"
+	"sort"
+	"strings"
+)
+
+// Segment kinds, ordered from least to most specific
+const (
+	segmentWildcard = iota // "*", matches the rest of the path
+	segmentParam           // "{name}", matches one segment
+	segmentLiteral         // matches itself
+)
+
+type segment struct {
+	kind  int
+	value string // literal text or parameter name
+}
+
+type route struct {
+	pattern  string
+	method   string // empty matches every method
+	segments []segment
+	handler  server.Handler
+}
+
+// Router dispatches requests to the handler registered for the most specific
+// pattern matching the method and path of the request.
+//
+// Patterns have the form "[METHOD ]/path", where a path segment can be a
+// literal, a "{name}" parameter matching one segment, or a final "*" matching
+// the rest of the path. Captured values are available through
+// req.PathValue(name), with the rest of a wildcard under "*". Paths are
+// split before being decoded, so "/users/a%2Fb" matches "/users/{id}" with id
+// "a/b". A trailing slash is part of the path: "/users/42/" doesn't match
+// "/users/{id}", only a pattern ending in "/" or "*" does. A GET route also
+// serves HEAD requests, unless a HEAD route for the same path is registered.
+type Router struct {
+	routes []*route
+}
+
+func New() *Router {
+	return &Router{}
+}
+
+// Handle registers h for pattern. It panics if the pattern is malformed or
+// already registered, like a duplicate case in a switch.
+func (rt *Router) Handle(pattern string, h server.Handler) {
+	r, err := parsePattern(pattern)
+	if err != nil {
+		panic(fmt.Sprintf("router: %v", err))
+	}
+	for _, existing := range rt.routes {
+		if existing.method == r.method && sameSegments(existing.segments, r.segments) {
+			panic(fmt.Sprintf("router: pattern %q conflicts with %q", pattern, existing.pattern))
+		}
+	}
+	r.handler = h
+	rt.routes = append(rt.routes, r)
+}
+
+// ServeHTTP is a server.Handler that dispatches req. It answers 404 Not Found
+// when no pattern matches the path and 405 Method Not Allowed, with an Allow
+// header, when patterns match the path but not the method.
+func (rt *Router) ServeHTTP(w *response.Writer, req *request.Request) {
+	pathSegments := req.URL.Segments()
+
+	var best *route
+	var bestValues map[string]string
+	allowed := map[string]bool{}
+	for _, r := range rt.routes {
+		values, ok := r.match(pathSegments)
+		if !ok {
+			continue
+		}
+		if !r.allows(req.RequestLine.Method) {
+			allowed[r.method] = true
+			if r.method == "GET" {
+				allowed["HEAD"] = true
+			}
+			continue
+		}
+		// A HEAD route beats the GET route it ties with
+		if best == nil || r.moreSpecific(best) || r.method == "HEAD" && !best.moreSpecific(r) {
+			best, bestValues = r, values
+		}
+	}
+
+	if best == nil {
+		if len(allowed) > 0 {
+			methodNotAllowed(w, allowed)
+			return
+		}
+		notFound(w)
+		return
+	}
+	for name, value := range bestValues {
+		req.SetPathValue(name, value)
+	}
+	best.handler(w, req)
+}
+
+func parsePattern(pattern string) (*route, error) {
+	r := &route{pattern: pattern}
+	path := pattern
+	if method, rest, ok := strings.Cut(pattern, " "); ok {
+		r.method = method
+		path = strings.TrimLeft(rest, " ")
+		for i := 0; i < len(method); i++ {
+			if method[i] < 'A' || method[i] > 'Z' {
+				return nil, fmt.Errorf("invalid method in pattern %q", pattern)
+			}
+		}
+	}
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("path in pattern %q must start with /", pattern)
+	}
+
+	names := map[string]bool{}
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	for i, part := range parts {
+		switch {
+		case part == "*":
+			if i != len(parts)-1 {
+				return nil, fmt.Errorf("wildcard must be the last segment in pattern %q", pattern)
+			}
+			r.segments = append(r.segments, segment{kind: segmentWildcard, value: "*"})
+		case strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}"):
+			name := part[1 : len(part)-1]
+			if name == "" || names[name] {
+				return nil, fmt.Errorf("empty or duplicate parameter name in pattern %q", pattern)
+			}
+			names[name] = true
+			r.segments = append(r.segments, segment{kind: segmentParam, value: name})
+		case strings.ContainsAny(part, "{}*"):
+			return nil, fmt.Errorf("invalid segment %q in pattern %q", part, pattern)
+		default:
+			r.segments = append(r.segments, segment{kind: segmentLiteral, value: part})
+		}
+	}
+	return r, nil
+}
+
+// allows reports whether the route serves requests with method
+func (r *route) allows(method string) bool {
+	return r.method == "" || r.method == method || r.method == "GET" && method == "HEAD"
+}
+
+// match reports whether the path segments match the route and returns the
+// captured parameters
+func (r *route) match(pathSegments []string) (map[string]string, bool) {
+	values := map[string]string{}
+	for i, seg := range r.segments {
+		if seg.kind == segmentWildcard {
+			values["*"] = strings.Join(pathSegments[i:], "/")
+			return values, true
+		}
+		if i >= len(pathSegments) {
+			return nil, false
+		}
+		switch seg.kind {
+		case segmentLiteral:
+			if pathSegments[i] != seg.value {
+				return nil, false
+			}
+		case segmentParam:
+			if pathSegments[i] == "" {
+				return nil, false
+			}
+			values[seg.value] = pathSegments[i]
+		}
+	}
+	return values, len(pathSegments) == len(r.segments)
+}
+
+// moreSpecific reports whether r should win over other when both match.
+// Segments are compared left to right: literals beat parameters which beat
+// wildcards. On a tie a route with a method beats one without.
+func (r *route) moreSpecific(other *route) bool {
+	for i := 0; i < len(r.segments) && i < len(other.segments); i++ {
+		if r.segments[i].kind != other.segments[i].kind {
+			return r.segments[i].kind > other.segments[i].kind
+		}
+	}
+	if len(r.segments) != len(other.segments) {
+		// Both matched, so the shorter one ends in a wildcard
+		return len(r.segments) > len(other.segments)
+	}
+	return r.method != "" && other.method == ""
+}
+
+func sameSegments(a, b []segment) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		// Parameter names don't matter, "/{a}" and "/{b}" match the same paths
+		if a[i].kind != b[i].kind || a[i].kind == segmentLiteral && a[i].value != b[i].value {
+			return false
+		}
+	}
+	return true
+}
+
+func notFound(w *response.Writer) {
+	rw := response.NewResponseWriter(w)
+	templates.WriteMessage(rw, response.StatusNotFound, "The requested resource could not be found.")
+	rw.Finish()
+}
+
+func methodNotAllowed(w *response.Writer, allowed map[string]bool) {
+	methods := make([]string, 0, len(allowed))
+	for method := range allowed {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+
+	rw := response.NewResponseWriter(w)
+	rw.Header().Set("Allow", strings.Join(methods, ", "))
+	templates.WriteMessage(rw, response.StatusMethodNotAllowed, "The requested resource does not support this method.")
+	rw.Finish()
+}
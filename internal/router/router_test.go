@@ -0,0 +1,105 @@
+package router
+
+import (
+	"bytes"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouter(t *testing.T) {
+	var matched string
+	var req *request.Request
+	handlerFor := func(name string) func(w *response.Writer, r *request.Request) {
+		return func(w *response.Writer, r *request.Request) {
+			matched = name
+			req = r
+		}
+	}
+	mux := New()
+	mux.Handle("GET /users/{id}", handlerFor("get user"))
+	mux.Handle("DELETE /users/{id}", handlerFor("delete user"))
+	mux.Handle("GET /users/me", handlerFor("me"))
+	mux.Handle("/static/*", handlerFor("static"))
+	mux.Handle("/", handlerFor("root"))
+
+	serve := func(requestLine string) string {
+		matched, req = "", nil
+		r, err := request.RequestFromReader(strings.NewReader(requestLine + "\r\nHost: localhost\r\n\r\n"))
+		require.NoError(t, err)
+		out := &bytes.Buffer{}
+		mux.ServeHTTP(response.NewWriter(out), r)
+		return out.String()
+	}
+
+	// Test: Parameter captured
+	serve("GET /users/42 HTTP/1.1")
+	assert.Equal(t, "get user", matched)
+	assert.Equal(t, "42", req.PathValue("id"))
+
+	// Test: Method selects the route
+	serve("DELETE /users/42 HTTP/1.1")
+	assert.Equal(t, "delete user", matched)
+
+	// Test: Literal beats parameter
+	serve("GET /users/me HTTP/1.1")
+	assert.Equal(t, "me", matched)
+
+	// Test: Wildcard captures the rest of the path, query excluded
+	serve("GET /static/css/site.css?v=1 HTTP/1.1")
+	assert.Equal(t, "static", matched)
+	assert.Equal(t, "css/site.css", req.PathValue("*"))
+
+	// Test: Dot-segments can't escape the matched prefix
+	serve("GET /static/../users/me HTTP/1.1")
+	assert.Equal(t, "me", matched)
+
+	// Test: An encoded slash stays inside its parameter
+	serve("GET /users/a%2Fb HTTP/1.1")
+	assert.Equal(t, "get user", matched)
+	assert.Equal(t, "a/b", req.PathValue("id"))
+
+	// Test: A trailing slash doesn't match a pattern without one
+	out := serve("GET /users/42/ HTTP/1.1")
+	assert.Equal(t, "", matched)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 404 Not Found\r\n"))
+
+	// Test: Exact root
+	serve("POST / HTTP/1.1")
+	assert.Equal(t, "root", matched)
+
+	// Test: No match
+	out = serve("GET /nope HTTP/1.1")
+	assert.Equal(t, "", matched)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 404 Not Found\r\n"))
+
+	// Test: Method mismatch
+	out = serve("POST /users/42 HTTP/1.1")
+	assert.Equal(t, "", matched)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 405 Method Not Allowed\r\n"))
+	assert.Contains(t, out, "Allow: DELETE, GET, HEAD\r\n")
+
+	// Test: GET route serves HEAD, a HEAD route takes precedence
+	serve("HEAD /users/42 HTTP/1.1")
+	assert.Equal(t, "get user", matched)
+	mux.Handle("HEAD /users/{id}", handlerFor("head user"))
+	serve("HEAD /users/42 HTTP/1.1")
+	assert.Equal(t, "head user", matched)
+	serve("GET /users/42 HTTP/1.1")
+	assert.Equal(t, "get user", matched)
+}
+
+func TestHandlePanics(t *testing.T) {
+	noop := func(w *response.Writer, r *request.Request) {}
+	mux := New()
+	mux.Handle("GET /users/{id}", noop)
+
+	assert.Panics(t, func() { mux.Handle("GET /users/{name}", noop) })
+	assert.Panics(t, func() { mux.Handle("users", noop) })
+	assert.Panics(t, func() { mux.Handle("/a/*/b", noop) })
+	assert.Panics(t, func() { mux.Handle("/{id}/{id}", noop) })
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"time"
+
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+)
+
+// Config holds the settings of a Server. A zero timeout or limit means no
+// timeout or limit.
+type Config struct {
+	Port int
+
+	// ReadHeaderTimeout is how long a client has to send the request line and
+	// headers once the first byte of a request arrives. On a new connection it
+	// also bounds the wait for that first byte.
+	ReadHeaderTimeout time.Duration
+	// ReadTimeout is how long a client has to send the whole request,
+	// including the body, once the first byte of a request arrives.
+	ReadTimeout time.Duration
+	// WriteTimeout is how long the handler has to write the response once the
+	// request has been read.
+	WriteTimeout time.Duration
+	// IdleTimeout is how long a kept-alive connection may wait for the next
+	// request. When zero, ReadTimeout is used instead.
+	IdleTimeout time.Duration
+	// HandlerTimeout cancels the request context that long after the handler
+	// is called. The handler is expected to give up once it sees that. It is
+	// also the only bound on a handler that doesn't read the request body, as
+	// the client disconnecting goes unnoticed until the body has been read.
+	HandlerTimeout time.Duration
+
+	// MaxRequestsPerConn is how many requests are served on one connection
+	// before it is closed.
+	MaxRequestsPerConn int
+	// Limits bounds the size of the request line, headers and body. Requests
+	// over a limit get a 414, 431 or 413 response.
+	Limits request.Limits
+
+	// Defaults are the headers added to every response, error pages
+	// included, unless the handler sets them. Date is sent unless omitted.
+	Defaults response.Defaults
+
+	// ErrorHandler writes the response for requests rejected before reaching
+	// the handler. When nil, DefaultErrorHandler is used.
+	ErrorHandler ErrorHandler
+
+	// PanicHook, if set, is called with the recovered value and the stack
+	// trace whenever a panic is recovered on a connection, e.g. to send it to
+	// an error reporting service. It runs on the connection goroutine.
+	PanicHook func(recovered any, stack []byte)
+}
+
+// DefaultConfig returns the configuration used by Serve
+func DefaultConfig(port int) Config {
+	return Config{
+		Port:               port,
+		ReadHeaderTimeout:  10 * time.Second,
+		IdleTimeout:        2 * time.Minute,
+		MaxRequestsPerConn: 100,
+		Limits:             request.DefaultLimits(),
+	}
+}
+
+func (c Config) idleTimeout() time.Duration {
+	if c.IdleTimeout != 0 {
+		return c.IdleTimeout
+	}
+	return c.ReadTimeout
+}
+
+// deadline returns the point in time timeout after start, or the zero time
+// (no deadline) if timeout is zero
+func deadline(start time.Time, timeout time.Duration) time.Time {
+	if timeout == 0 {
+		return time.Time{}
+	}
+	return start.Add(timeout)
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// A deadline in the past, used to unblock a pending read
+var aLongTimeAgo = time.Unix(1, 0)
+
+// connReader sits between the connection and the request reader. While a
+// handler runs it keeps a one-byte read pending on the connection, so that a
+// client going away cancels the request context instead of going unnoticed.
+// A byte that arrives meanwhile (a pipelined request) is kept for the next Read.
+type connReader struct {
+	conn net.Conn
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	inRead  bool // a background read is pending
+	aborted bool // the pending read was unblocked on purpose
+	hasByte bool
+	byteBuf [1]byte
+	cancel  context.CancelFunc
+}
+
+func newConnReader(conn net.Conn) *connReader {
+	cr := &connReader{conn: conn}
+	cr.cond = sync.NewCond(&cr.mu)
+	return cr
+}
+
+func (cr *connReader) Read(p []byte) (int, error) {
+	cr.mu.Lock()
+	if cr.inRead {
+		cr.mu.Unlock()
+		panic("server: read on connection while a background read is pending")
+	}
+	if cr.hasByte && len(p) > 0 {
+		p[0] = cr.byteBuf[0]
+		cr.hasByte = false
+		cr.mu.Unlock()
+		return 1, nil
+	}
+	cr.mu.Unlock()
+	return cr.conn.Read(p)
+}
+
+// startBackgroundRead starts watching the connection, calling cancel if the
+// client closes it or the connection breaks
+func (cr *connReader) startBackgroundRead(cancel context.CancelFunc) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if cr.inRead {
+		panic("server: background read already pending")
+	}
+	if cr.hasByte {
+		// The next request already started, the client is still there
+		return
+	}
+	cr.inRead = true
+	cr.cancel = cancel
+	cr.conn.SetReadDeadline(time.Time{})
+	go cr.backgroundRead()
+}
+
+func (cr *connReader) backgroundRead() {
+	n, err := cr.conn.Read(cr.byteBuf[:])
+	cr.mu.Lock()
+	if n == 1 {
+		cr.hasByte = true
+	}
+	if err != nil && !(cr.aborted && isTimeout(err)) {
+		// The client went away while the handler was running
+		cr.cancel()
+	}
+	cr.aborted = false
+	cr.inRead = false
+	cr.mu.Unlock()
+	cr.cond.Broadcast()
+}
+
+// abortPendingRead stops the background read, if any, and waits for it to
+// return so the connection can be read normally again
+func (cr *connReader) abortPendingRead() {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if !cr.inRead {
+		return
+	}
+	cr.aborted = true
+	cr.conn.SetReadDeadline(aLongTimeAgo)
+	for cr.inRead {
+		cr.cond.Wait()
+	}
+	cr.conn.SetReadDeadline(time.Time{})
+}
+
+// bodyWatcher calls onEOF once the request body has been read to the end,
+// unless stop was called first
+type bodyWatcher struct {
+	io.ReadCloser
+	onEOF   func()
+	stopped bool
+}
+
+func (bw *bodyWatcher) Read(p []byte) (int, error) {
+	n, err := bw.ReadCloser.Read(p)
+	if err == io.EOF && !bw.stopped {
+		bw.stopped = true
+		bw.onEOF()
+	}
+	return n, err
+}
+
+func (bw *bodyWatcher) stop() {
+	bw.stopped = true
+}
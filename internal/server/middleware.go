@@ -0,0 +1,15 @@
+package server
+
+// Middleware wraps a Handler to add behaviour around it, e.g. logging or
+// authentication. After calling next, a middleware can inspect
+// w.StatusCode() and w.BytesWritten() to see what the handler wrote.
+type Middleware func(next Handler) Handler
+
+// Chain wraps h with the middlewares. The first middleware is the outermost:
+// Chain(h, a, b) runs a, then b, then h.
+func Chain(h Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
@@ -1,13 +1,20 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"httpfromtcp/internal/httperr"
 	"httpfromtcp/internal/request"
 	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/templates"
 	"io"
 	"log"
 	"net"
+	"runtime/debug"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 const (
@@ -16,11 +23,37 @@ const (
 	serverStateInitialized = 0
 )
 
+const (
+	// How often Shutdown checks whether all connections are gone
+	shutdownPollInterval = 50 * time.Millisecond
+	// How long and how much to keep reading after an error response
+	lingerTimeout  = 500 * time.Millisecond
+	lingerMaxBytes = 256 * 1024
+	// How long and how much unread request body to discard to keep a connection alive
+	discardBodyTimeout  = 5 * time.Second
+	discardBodyMaxBytes = 256 * 1024
+)
+
+// Connection state constants
+const (
+	connStateNew    = iota // accepted, no byte received yet
+	connStateActive        // a request is being read or handled
+	connStateIdle          // waiting for the next request on a kept-alive connection
+)
+
 type Server struct {
 	listener net.Listener
 	state    atomic.Int32
 	closed   atomic.Bool
 	handler  Handler
+	config   Config
+
+	mu    sync.Mutex
+	conns map[net.Conn]int // tracked connections and their state
+
+	// Parent of every request context, cancelled by Close
+	baseCtx    context.Context
+	cancelBase context.CancelFunc
 }
 
 type HandlerError struct {
@@ -35,8 +68,58 @@ func (e *HandlerError) Write(w io.Writer) {
 
 type Handler func(w *response.Writer, req *request.Request)
 
+// Adapt turns a handler written against the net/http-style
+// response.ResponseWriter into a Handler. The response is finished when h
+// returns, a failure to do so is reported by the server's own check.
+func Adapt(h func(w *response.ResponseWriter, req *request.Request)) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		rw := response.NewResponseWriter(w)
+		h(rw, req)
+		rw.Finish()
+	}
+}
+
+// ErrorHandler writes the response sent when the server rejects a request
+// before it reaches the Handler, e.g. because it could not be parsed. The
+// connection is closed afterwards.
+type ErrorHandler func(w *response.Writer, herr *HandlerError)
+
+// DefaultErrorHandler writes herr as a small HTML page
+func DefaultErrorHandler(w *response.Writer, herr *HandlerError) {
+	rw := response.NewResponseWriter(w)
+	templates.WriteMessage(rw, response.StatusCode(herr.Code), herr.Message)
+	rw.Finish()
+}
+
+// parseErrorToHandlerError maps an error returned while reading a request to
+// the response the client should get
+func parseErrorToHandlerError(err error) *HandlerError {
+	switch {
+	case isTimeout(err):
+		return &HandlerError{Code: int(response.StatusRequestTimeout), Message: "The server timed out waiting for the request."}
+	case errors.Is(err, httperr.KindRequestLineTooLong):
+		return &HandlerError{Code: int(response.StatusURITooLong), Message: "The request line is longer than the server is willing to interpret."}
+	case errors.Is(err, httperr.KindHeadersTooLarge):
+		return &HandlerError{Code: int(response.StatusRequestHeaderFieldsTooLarge), Message: "The request header fields are too large."}
+	case errors.Is(err, httperr.KindBodyTooLarge):
+		return &HandlerError{Code: int(response.StatusContentTooLarge), Message: "The request body is larger than the server is willing to process."}
+	case errors.Is(err, httperr.KindUnsupportedVersion):
+		return &HandlerError{Code: int(response.StatusHTTPVersionNotSupported), Message: "Only HTTP/1.0 and HTTP/1.1 are supported."}
+	case errors.Is(err, httperr.KindUnsupportedTransferEncoding):
+		return &HandlerError{Code: int(response.StatusNotImplemented), Message: "The request transfer coding is not supported."}
+	default:
+		return &HandlerError{Code: int(response.StatusBadRequest), Message: "The request could not be parsed."}
+	}
+}
+
+// Serve starts a server on port with the default configuration
 func Serve(port int, h Handler) (*Server, error) {
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	return ServeConfig(DefaultConfig(port), h)
+}
+
+// ServeConfig starts a server with the given configuration
+func ServeConfig(config Config, h Handler) (*Server, error) {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", config.Port))
 	if err != nil {
 		return nil, err
 	}
@@ -44,7 +127,10 @@ func Serve(port int, h Handler) (*Server, error) {
 	srv := &Server{
 		listener: listener,
 		handler:  h,
+		config:   config,
+		conns:    make(map[net.Conn]int),
 	}
+	srv.baseCtx, srv.cancelBase = context.WithCancel(context.Background())
 	srv.state.Store(serverStateInitialized)
 
 	go srv.listen()
@@ -52,17 +138,92 @@ func Serve(port int, h Handler) (*Server, error) {
 	return srv, nil
 }
 
+// Close stops accepting new connections, cancels the context of every
+// in-flight request and immediately closes all the tracked connections. Use
+// Shutdown to let in-flight requests finish.
 func (s *Server) Close() error {
-	if s.listener != nil {
-		err := s.listener.Close()
-		if err != nil {
+	err := s.closeListener()
+	s.cancelBase()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+		delete(s.conns, conn)
+	}
+	return err
+}
+
+// Shutdown stops accepting new connections, closes idle ones and waits for
+// the active ones to finish their current request. If ctx expires first the
+// remaining connections are force-closed and an error reporting how many were
+// cut off is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.closeListener()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.closeIdleConns() {
 			return err
 		}
-		s.listener = nil
+		select {
+		case <-ctx.Done():
+			s.mu.Lock()
+			cutOff := len(s.conns)
+			s.mu.Unlock()
+			s.Close()
+			return fmt.Errorf("server shutdown: %d connection(s) force-closed: %w", cutOff, ctx.Err())
+		case <-ticker.C:
+		}
 	}
+}
+
+func (s *Server) closeListener() error {
 	//s.state.Store(serverStateClosed)
-	s.closed.Store(true)
-	return nil
+	// Flag first so listen() does not log the error Accept returns on close
+	if s.closed.Swap(true) {
+		return nil
+	}
+	return s.listener.Close()
+}
+
+// closeIdleConns closes every connection without a request in progress, new
+// ones that haven't sent a byte yet and kept-alive ones waiting for the next
+// request, and reports whether no connections are left.
+func (s *Server) closeIdleConns() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn, state := range s.conns {
+		if state != connStateActive {
+			conn.Close()
+			delete(s.conns, conn)
+		}
+	}
+	return len(s.conns) == 0
+}
+
+func (s *Server) trackConn(conn net.Conn, state int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conns[conn] = state
+}
+
+func (s *Server) untrackConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
+
+// setConnState moves a tracked connection to a new state. It returns false if
+// the connection is no longer tracked because the server closed it.
+func (s *Server) setConnState(conn net.Conn, state int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.conns[conn]; !ok {
+		return false
+	}
+	s.conns[conn] = state
+	return true
 }
 
 func (s *Server) listen() {
@@ -80,26 +241,234 @@ func (s *Server) listen() {
 			log.Println("Error accepting connection:", err)
 			continue
 		}
+		if s.closed.Load() {
+			// Accepted while the server was closing
+			conn.Close()
+			return
+		}
+		s.trackConn(conn, connStateNew)
 		go s.handle(conn)
 	}
 }
 
 func (s *Server) handle(conn net.Conn) {
+	defer s.untrackConn(conn)
 	defer conn.Close()
+	// A panic while reading a request must not take the whole process down
+	defer func() {
+		if v := recover(); v != nil {
+			s.reportPanic(conn, v)
+		}
+	}()
 
-	// Parse the request from the connection
-	req, err := request.RequestFromReader(conn)
-	if err != nil {
-		log.Println("Error parsing request:", err)
-		// Handle the error (e.g., send an error response)
-		//conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
-		return
+	// Requests are cancelled when the connection ends
+	connCtx, cancelConn := context.WithCancel(s.baseCtx)
+	defer cancelConn()
+
+	// Keep reading requests off the same connection until one side asks to close
+	cr := newConnReader(conn)
+	reader := request.NewReaderWithLimits(cr, s.config.Limits)
+	for requests := 1; ; requests++ {
+		// Wait for the first bytes of the next request. A new connection gets
+		// the header timeout, a kept-alive one the idle timeout.
+		waitTimeout := s.config.ReadHeaderTimeout
+		if requests > 1 {
+			if !s.setConnState(conn, connStateIdle) {
+				return
+			}
+			waitTimeout = s.config.idleTimeout()
+		}
+		conn.SetReadDeadline(deadline(time.Now(), waitTimeout))
+		if err := reader.WaitForRequest(); err != nil {
+			if !isQuietError(err) {
+				log.Println("Error reading request:", err)
+			}
+			return
+		}
+		// A request has started arriving, Shutdown must now let it finish
+		if !s.setConnState(conn, connStateActive) {
+			return
+		}
+
+		// Parse the request line and headers from the connection, the body is
+		// read by the handler on demand
+		start := time.Now()
+		conn.SetReadDeadline(deadline(start, s.config.ReadHeaderTimeout))
+		req, err := reader.ReadRequest()
+		if err != nil {
+			// A client that disconnected mid-request gets no answer
+			if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if !isTimeout(err) {
+				log.Println("Error parsing request:", err)
+			}
+			// Send an error response, the rest of the stream can't be trusted so close afterwards
+			s.writeError(conn, parseErrorToHandlerError(err))
+			return
+		}
+		// The whole request, body included, must arrive within the read timeout
+		conn.SetReadDeadline(deadline(start, s.config.ReadTimeout))
+		req.RemoteAddr = conn.RemoteAddr().String()
+
+		// Create a new response writer
+		conn.SetWriteDeadline(deadline(time.Now(), s.config.WriteTimeout))
+		w := response.NewWriter(conn)
+		w.SetDefaults(s.config.Defaults)
+		w.SetHTTP10(!req.RequestLine.ProtoAtLeast(1, 1))
+		// A HEAD request is handled like GET, minus the body
+		w.SetDiscardBody(req.RequestLine.Method == "HEAD")
+		w.SetKeepAlive(keepAliveRequested(req) &&
+			(s.config.MaxRequestsPerConn == 0 || requests < s.config.MaxRequestsPerConn) &&
+			!s.closed.Load())
+		// Too much body left unread when the response starts means closing,
+		// the response must say so
+		w.SetKeepAliveCheck(func() bool { return reader.CanDiscardBody(discardBodyMaxBytes) })
+
+		// The request context ends with the connection, the server or the handler timeout
+		var ctx context.Context
+		var cancelRequest context.CancelFunc
+		if s.config.HandlerTimeout > 0 {
+			ctx, cancelRequest = context.WithTimeout(connCtx, s.config.HandlerTimeout)
+		} else {
+			ctx, cancelRequest = context.WithCancel(connCtx)
+		}
+		req = req.WithContext(ctx)
+		// Watch for the client going away while the handler runs. The
+		// connection can only be watched once the body has been read.
+		var watcher *bodyWatcher
+		if req.Body == request.NoBody {
+			cr.startBackgroundRead(cancelRequest)
+		} else {
+			watcher = &bodyWatcher{ReadCloser: req.Body, onEOF: func() { cr.startBackgroundRead(cancelRequest) }}
+			req.Body = watcher
+		}
+
+		// Call the handler with the response writer and request
+		ok := s.runHandler(conn, w, req)
+		// A handler that wrote nothing is answered once the body is discarded
+		wroteNothing := ok && w.StatusCode() == 0
+		if ok && !wroteNothing {
+			// A body cut short leaves the connection unusable
+			if err := w.Finish(); err != nil {
+				log.Println("Error finishing response:", err)
+				ok = false
+			}
+		}
+		if watcher != nil {
+			watcher.stop()
+		}
+		cr.abortPendingRead()
+		cancelRequest()
+		if req.MultipartForm != nil {
+			req.MultipartForm.RemoveAll()
+		}
+		if !ok {
+			return
+		}
+
+		// Discard what the handler left of the body to reach the next request
+		conn.SetReadDeadline(time.Now().Add(discardBodyTimeout))
+		bodyErr := reader.FinishBody(discardBodyMaxBytes)
+		if wroteNothing {
+			// A chunked body only turns out too large while it is read
+			if errors.Is(bodyErr, httperr.KindBodyTooLarge) {
+				s.writeError(conn, parseErrorToHandlerError(bodyErr))
+				return
+			}
+			// Finish sends an empty 200 in place of the missing response
+			if err := w.Finish(); errors.Is(err, response.ErrNoResponse) {
+				log.Printf("Warning: handler wrote no response to %s %s, sent an empty 200", req.RequestLine.Method, req.RequestLine.RequestTarget)
+			} else {
+				log.Println("Error finishing response:", err)
+				return
+			}
+		}
+		if bodyErr != nil {
+			// The client may still be sending the body
+			lingerClose(conn)
+			return
+		}
+
+		if !w.KeepAlive() || s.closed.Load() {
+			return
+		}
+		conn.SetWriteDeadline(time.Time{})
 	}
+}
 
-	// Create a new response writer
-	w := response.NewWriter(conn)
+// keepAliveRequested reports whether the client wants to reuse the connection.
+// HTTP/1.1 does by default, HTTP/1.0 only with "Connection: keep-alive".
+func keepAliveRequested(req *request.Request) bool {
+	if req.Headers.HasToken("Connection", "close") {
+		return false
+	}
+	return req.RequestLine.ProtoAtLeast(1, 1) || req.Headers.HasToken("Connection", "keep-alive")
+}
 
-	// Call the handler with the response writer and request
+// runHandler calls the handler and recovers from a panic in it. If nothing
+// was written yet the client gets a 500, otherwise the response is cut short.
+// It returns false if the handler panicked and the connection must be closed.
+func (s *Server) runHandler(conn net.Conn, w *response.Writer, req *request.Request) (ok bool) {
+	defer func() {
+		if v := recover(); v != nil {
+			ok = false
+			s.reportPanic(conn, v)
+			if w.StatusCode() == 0 {
+				s.writeError(conn, &HandlerError{
+					Code:    int(response.StatusInternalServerError),
+					Message: "The server encountered an internal error.",
+				})
+			}
+		}
+	}()
 	s.handler(w, req)
+	return true
+}
+
+// reportPanic logs a recovered panic with its stack trace and passes it to
+// the configured PanicHook
+func (s *Server) reportPanic(conn net.Conn, v any) {
+	stack := debug.Stack()
+	log.Printf("Panic serving %s: %v\n%s", conn.RemoteAddr(), v, stack)
+	if s.config.PanicHook != nil {
+		s.config.PanicHook(v, stack)
+	}
+}
+
+// writeError sends the error response for herr through the configured
+// ErrorHandler and asks the client to close the connection
+func (s *Server) writeError(conn net.Conn, herr *HandlerError) {
+	conn.SetWriteDeadline(deadline(time.Now(), s.config.WriteTimeout))
+	w := response.NewWriter(conn)
+	w.SetDefaults(s.config.Defaults)
+	errorHandler := s.config.ErrorHandler
+	if errorHandler == nil {
+		errorHandler = DefaultErrorHandler
+	}
+	errorHandler(w, herr)
+	lingerClose(conn)
+}
+
+// lingerClose prepares conn to be closed with data from the client possibly
+// still unread. Closing with unread data makes the kernel send a reset, which
+// can destroy the response before the client reads it. Half-close and drain
+// what the client is still sending for a moment instead.
+func lingerClose(conn net.Conn) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.CloseWrite()
+		tcpConn.SetReadDeadline(time.Now().Add(lingerTimeout))
+		io.Copy(io.Discard, io.LimitReader(tcpConn, lingerMaxBytes))
+	}
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
 
+// isQuietError reports whether err is a normal way for a connection to end:
+// the client went away, stayed idle for too long or the server closed it
+func isQuietError(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) || isTimeout(err)
 }
@@ -0,0 +1,503 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testResponse is a response read back from the server
+type testResponse struct {
+	statusLine string
+	headers    *headers.Headers
+	body       string
+}
+
+// startServer starts a server on a free loopback port, closed when the test ends
+func startServer(t *testing.T, config Config, h Handler) *Server {
+	config.Port = 0
+	srv, err := ServeConfig(config, h)
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.Close() })
+	return srv
+}
+
+// dial opens a connection to srv that fails the reads of a stuck test
+func dial(t *testing.T, srv *Server) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", srv.listener.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn, bufio.NewReader(conn)
+}
+
+// readResponse reads one response framed by its Content-Length
+func readResponse(t *testing.T, r *bufio.Reader) testResponse {
+	statusLine, err := r.ReadString('\n')
+	require.NoError(t, err)
+	resp := testResponse{statusLine: strings.TrimSuffix(statusLine, "\r\n"), headers: headers.NewHeaders()}
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimSuffix(line, "\r\n")
+		if line == "" {
+			break
+		}
+		name, value, _ := strings.Cut(line, ":")
+		resp.headers.Add(name, strings.TrimSpace(value))
+	}
+	if value, ok := resp.headers.Get("Content-Length"); ok {
+		n, err := strconv.Atoi(value)
+		require.NoError(t, err)
+		body := make([]byte, n)
+		_, err = io.ReadFull(r, body)
+		require.NoError(t, err)
+		resp.body = string(body)
+	}
+	return resp
+}
+
+// connState returns the tracked state of the only connection of srv, or -1
+func connState(srv *Server) int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for _, state := range srv.conns {
+		return state
+	}
+	return -1
+}
+
+func okHandler(w *response.Writer, req *request.Request) {
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(response.GetDefaultHeaders(2))
+	w.WriteBody([]byte("ok"))
+}
+
+func TestShutdown(t *testing.T) {
+	// Test: A request being handled is finished before Shutdown returns
+	release := make(chan struct{})
+	srv := startServer(t, DefaultConfig(0), func(w *response.Writer, req *request.Request) {
+		<-release
+		okHandler(w, req)
+	})
+	conn, r := dial(t, srv)
+	_, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return connState(srv) == connStateActive }, time.Second, time.Millisecond)
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		shutdownErr <- srv.Shutdown(ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	resp := readResponse(t, r)
+	assert.Equal(t, "ok", resp.body)
+	require.NoError(t, <-shutdownErr)
+	_, err = r.ReadByte()
+	require.ErrorIs(t, err, io.EOF)
+
+	// Test: A request that started arriving is served before Shutdown returns
+	srv = startServer(t, DefaultConfig(0), okHandler)
+	conn, r = dial(t, srv)
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\n")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return connState(srv) == connStateActive }, time.Second, time.Millisecond)
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		shutdownErr <- srv.Shutdown(ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	_, err = io.WriteString(conn, "\r\n")
+	require.NoError(t, err)
+	resp = readResponse(t, r)
+	assert.Equal(t, "HTTP/1.1 200 OK", resp.statusLine)
+	assert.Equal(t, "ok", resp.body)
+	// Shutting down, so the connection isn't kept alive
+	connection, _ := resp.headers.Get("Connection")
+	assert.Equal(t, "close", connection)
+	require.NoError(t, <-shutdownErr)
+
+	// Test: Connections without a request are closed right away
+	srv = startServer(t, DefaultConfig(0), okHandler)
+	_, r = dial(t, srv)
+	require.Eventually(t, func() bool { return connState(srv) == connStateNew }, time.Second, time.Millisecond)
+	require.NoError(t, srv.Shutdown(context.Background()))
+	_, err = r.ReadByte()
+	require.ErrorIs(t, err, io.EOF)
+
+	// Test: Connections still busy when the context expires are force-closed
+	stuck := make(chan struct{})
+	defer close(stuck)
+	srv = startServer(t, DefaultConfig(0), func(w *response.Writer, req *request.Request) {
+		<-stuck
+	})
+	conn, _ = dial(t, srv)
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return connState(srv) == connStateActive }, time.Second, time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = srv.Shutdown(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Contains(t, err.Error(), "1 connection(s) force-closed")
+}
+
+func TestKeepAlive(t *testing.T) {
+	config := DefaultConfig(0)
+	config.MaxRequestsPerConn = 3
+	srv := startServer(t, config, okHandler)
+
+	// Test: Pipelined requests are answered in order on one connection
+	conn, r := dial(t, srv)
+	_, err := io.WriteString(conn, "GET /1 HTTP/1.1\r\nHost: x\r\n\r\nGET /2 HTTP/1.1\r\nHost: x\r\n\r\n")
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		resp := readResponse(t, r)
+		assert.Equal(t, "HTTP/1.1 200 OK", resp.statusLine)
+		assert.Equal(t, "ok", resp.body)
+		connection, _ := resp.headers.Get("Connection")
+		assert.Equal(t, "keep-alive", connection)
+	}
+
+	// Test: The last request allowed on the connection closes it
+	_, err = io.WriteString(conn, "GET /3 HTTP/1.1\r\nHost: x\r\n\r\n")
+	require.NoError(t, err)
+	resp := readResponse(t, r)
+	connection, _ := resp.headers.Get("Connection")
+	assert.Equal(t, "close", connection)
+	_, err = r.ReadByte()
+	require.ErrorIs(t, err, io.EOF)
+
+	// Test: Connection: close from the client
+	conn, r = dial(t, srv)
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	require.NoError(t, err)
+	resp = readResponse(t, r)
+	connection, _ = resp.headers.Get("Connection")
+	assert.Equal(t, "close", connection)
+	_, err = r.ReadByte()
+	require.ErrorIs(t, err, io.EOF)
+
+	// Test: HTTP/1.0 closes by default and stays open when asked to
+	conn, r = dial(t, srv)
+	_, err = io.WriteString(conn, "GET / HTTP/1.0\r\n\r\n")
+	require.NoError(t, err)
+	resp = readResponse(t, r)
+	connection, _ = resp.headers.Get("Connection")
+	assert.Equal(t, "close", connection)
+	_, err = r.ReadByte()
+	require.ErrorIs(t, err, io.EOF)
+
+	conn, r = dial(t, srv)
+	_, err = io.WriteString(conn, "GET / HTTP/1.0\r\nConnection: keep-alive\r\n\r\nGET / HTTP/1.0\r\n\r\n")
+	require.NoError(t, err)
+	resp = readResponse(t, r)
+	connection, _ = resp.headers.Get("Connection")
+	assert.Equal(t, "keep-alive", connection)
+	resp = readResponse(t, r)
+	assert.Equal(t, "ok", resp.body)
+}
+
+func TestUnreadBody(t *testing.T) {
+	srv := startServer(t, DefaultConfig(0), okHandler)
+	send := func(conn net.Conn, raw string) {
+		// The server may stop reading before the whole request is written
+		go io.WriteString(conn, raw)
+	}
+
+	// Test: A small unread body is discarded and the connection kept
+	conn, r := dial(t, srv)
+	send(conn, "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 1024\r\n\r\n"+strings.Repeat("a", 1024)+"GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	for i := 0; i < 2; i++ {
+		resp := readResponse(t, r)
+		connection, _ := resp.headers.Get("Connection")
+		assert.Equal(t, "keep-alive", connection)
+	}
+
+	// Test: Too much unread body closes the connection, without a reset
+	conn, r = dial(t, srv)
+	body := strings.Repeat("a", 300*1024)
+	send(conn, "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 307200\r\n\r\n"+body+"GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	resp := readResponse(t, r)
+	assert.Equal(t, "ok", resp.body)
+	connection, _ := resp.headers.Get("Connection")
+	assert.Equal(t, "close", connection)
+	_, err := r.ReadByte()
+	require.ErrorIs(t, err, io.EOF)
+
+	// Test: So does an unread chunked body, whose size is unknown
+	conn, r = dial(t, srv)
+	send(conn, "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n")
+	resp = readResponse(t, r)
+	connection, _ = resp.headers.Get("Connection")
+	assert.Equal(t, "close", connection)
+	_, err = r.ReadByte()
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestIncompleteResponse(t *testing.T) {
+	config := DefaultConfig(0)
+	config.Limits.MaxBodyBytes = 16
+	srv := startServer(t, config, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/status" {
+			w.WriteStatusLine(response.StatusAccepted)
+		}
+	})
+
+	// Test: A handler writing nothing gets an empty 200 and the connection
+	// stays usable
+	conn, r := dial(t, srv)
+	_, err := io.WriteString(conn, "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 5\r\n\r\nhelloGET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		resp := readResponse(t, r)
+		assert.Equal(t, "HTTP/1.1 200 OK", resp.statusLine)
+		contentLength, _ := resp.headers.Get("Content-Length")
+		assert.Equal(t, "0", contentLength)
+		connection, _ := resp.headers.Get("Connection")
+		assert.Equal(t, "keep-alive", connection)
+	}
+
+	// Test: A chunked body found too large while discarding it still gets a 413
+	conn, r = dial(t, srv)
+	_, err = io.WriteString(conn, "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n20\r\n"+strings.Repeat("a", 32)+"\r\n0\r\n\r\n")
+	require.NoError(t, err)
+	resp := readResponse(t, r)
+	assert.Equal(t, "HTTP/1.1 413 Content Too Large", resp.statusLine)
+
+	// Test: A status line alone is completed and the connection closed
+	conn, r = dial(t, srv)
+	_, err = io.WriteString(conn, "GET /status HTTP/1.1\r\nHost: x\r\n\r\n")
+	require.NoError(t, err)
+	resp = readResponse(t, r)
+	assert.Equal(t, "HTTP/1.1 202 Accepted", resp.statusLine)
+	connection, _ := resp.headers.Get("Connection")
+	assert.Equal(t, "close", connection)
+	_, err = r.ReadByte()
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestTimeouts(t *testing.T) {
+	config := DefaultConfig(0)
+	config.ReadHeaderTimeout = 100 * time.Millisecond
+	config.IdleTimeout = 100 * time.Millisecond
+	srv := startServer(t, config, okHandler)
+
+	// Test: A request head arriving too slowly gets a 408
+	conn, r := dial(t, srv)
+	_, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\n")
+	require.NoError(t, err)
+	resp := readResponse(t, r)
+	assert.Equal(t, "HTTP/1.1 408 Request Timeout", resp.statusLine)
+	_, err = r.ReadByte()
+	require.ErrorIs(t, err, io.EOF)
+
+	// Test: A connection that never sends a request is closed silently
+	_, r = dial(t, srv)
+	_, err = r.ReadByte()
+	require.ErrorIs(t, err, io.EOF)
+
+	// Test: A kept-alive connection is closed once idle for too long
+	conn, r = dial(t, srv)
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	require.NoError(t, err)
+	resp = readResponse(t, r)
+	assert.Equal(t, "ok", resp.body)
+	start := time.Now()
+	_, err = r.ReadByte()
+	require.ErrorIs(t, err, io.EOF)
+	assert.Less(t, time.Since(start), 2*time.Second)
+}
+
+func TestParseErrorResponses(t *testing.T) {
+	config := DefaultConfig(0)
+	config.Limits.MaxBodyBytes = 16
+	srv := startServer(t, config, okHandler)
+	send := func(raw string) testResponse {
+		conn, r := dial(t, srv)
+		_, err := io.WriteString(conn, raw)
+		require.NoError(t, err)
+		resp := readResponse(t, r)
+		connection, _ := resp.headers.Get("Connection")
+		assert.Equal(t, "close", connection)
+		return resp
+	}
+
+	var manyHeaders strings.Builder
+	for i := 0; i <= 100; i++ {
+		fmt.Fprintf(&manyHeaders, "X-A%d: 1\r\n", i)
+	}
+
+	// Test: Each kind of parse error gets its status code
+	tests := []struct {
+		raw  string
+		code response.StatusCode
+	}{
+		{"get / HTTP/1.1\r\nHost: x\r\n\r\n", response.StatusBadRequest},
+		{"GET /" + strings.Repeat("a", 9000) + " HTTP/1.1\r\n\r\n", response.StatusURITooLong},
+		{"GET / HTTP/1.1\r\n" + manyHeaders.String() + "\r\n", response.StatusRequestHeaderFieldsTooLarge},
+		{"POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 17\r\n\r\n", response.StatusContentTooLarge},
+		{"GET / HTTP/2.0\r\nHost: x\r\n\r\n", response.StatusHTTPVersionNotSupported},
+		{"POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: gzip, chunked\r\n\r\n", response.StatusNotImplemented},
+	}
+	for _, tt := range tests {
+		resp := send(tt.raw)
+		assert.True(t, strings.HasPrefix(resp.statusLine, fmt.Sprintf("HTTP/1.1 %d ", tt.code)), resp.statusLine)
+	}
+
+	// Test: A custom ErrorHandler writes the error response
+	config.ErrorHandler = func(w *response.Writer, herr *HandlerError) {
+		w.WriteStatusLine(response.StatusCode(herr.Code))
+		h := response.GetDefaultHeaders(len("custom"))
+		h.Set("Content-Type", "text/plain")
+		w.WriteHeaders(h)
+		w.WriteBody([]byte("custom"))
+	}
+	srv = startServer(t, config, okHandler)
+	resp := send("get / HTTP/1.1\r\nHost: x\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 400 Bad Request", resp.statusLine)
+	assert.Equal(t, "custom", resp.body)
+}
+
+func TestChain(t *testing.T) {
+	var calls []string
+	var status response.StatusCode
+	var written int64
+	trace := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(w *response.Writer, req *request.Request) {
+				calls = append(calls, name+" before")
+				next(w, req)
+				calls = append(calls, name+" after")
+				if name == "a" {
+					status, written = w.StatusCode(), w.BytesWritten()
+				}
+			}
+		}
+	}
+	h := Chain(func(w *response.Writer, req *request.Request) {
+		calls = append(calls, "handler")
+		okHandler(w, req)
+	}, trace("a"), trace("b"))
+
+	// Test: The first middleware is the outermost
+	req, err := request.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: x\r\n\r\n"))
+	require.NoError(t, err)
+	h(response.NewWriter(io.Discard), req)
+	assert.Equal(t, []string{"a before", "b before", "handler", "b after", "a after"}, calls)
+
+	// Test: What the handler wrote is visible after next returns
+	assert.Equal(t, response.StatusOK, status)
+	assert.Equal(t, int64(2), written)
+}
+
+func TestPanicRecovery(t *testing.T) {
+	hooked := make(chan any, 2)
+	config := DefaultConfig(0)
+	config.PanicHook = func(recovered any, stack []byte) {
+		assert.NotEmpty(t, stack)
+		hooked <- recovered
+	}
+	srv := startServer(t, config, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/late" {
+			w.WriteStatusLine(response.StatusOK)
+			w.WriteHeaders(response.GetDefaultHeaders(10))
+			w.Write([]byte("part"))
+		}
+		panic("boom")
+	})
+
+	// Test: A panic before anything was written gets a 500
+	conn, r := dial(t, srv)
+	_, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	require.NoError(t, err)
+	resp := readResponse(t, r)
+	assert.Equal(t, "HTTP/1.1 500 Internal Server Error", resp.statusLine)
+	assert.Equal(t, "boom", <-hooked)
+	_, err = r.ReadByte()
+	require.ErrorIs(t, err, io.EOF)
+
+	// Test: A panic mid-response cuts the connection
+	conn, r = dial(t, srv)
+	_, err = io.WriteString(conn, "GET /late HTTP/1.1\r\nHost: x\r\n\r\n")
+	require.NoError(t, err)
+	data, _ := io.ReadAll(r)
+	assert.True(t, strings.HasPrefix(string(data), "HTTP/1.1 200 OK\r\n"))
+	assert.True(t, strings.HasSuffix(string(data), "\r\n\r\npart"))
+	assert.Equal(t, "boom", <-hooked)
+
+	// Test: The server keeps serving other connections
+	conn, r = dial(t, srv)
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	require.NoError(t, err)
+	resp = readResponse(t, r)
+	assert.Equal(t, "HTTP/1.1 500 Internal Server Error", resp.statusLine)
+	<-hooked
+}
+
+func TestRequestContext(t *testing.T) {
+	done := make(chan error, 1)
+	waitForCancel := func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.Method == "POST" {
+			io.ReadAll(req.Body)
+		}
+		select {
+		case <-req.Context().Done():
+			done <- req.Context().Err()
+		case <-time.After(2 * time.Second):
+			done <- nil
+		}
+	}
+
+	// Test: The client disconnecting cancels the context
+	srv := startServer(t, DefaultConfig(0), waitForCancel)
+	conn, _ := dial(t, srv)
+	_, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	conn.Close()
+	require.ErrorIs(t, <-done, context.Canceled)
+
+	// Test: So it does once the handler has read the body
+	conn, _ = dial(t, srv)
+	_, err = io.WriteString(conn, "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 3\r\n\r\nabc")
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	conn.Close()
+	require.ErrorIs(t, <-done, context.Canceled)
+
+	// Test: Closing the server cancels the context
+	conn, _ = dial(t, srv)
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return connState(srv) == connStateActive }, time.Second, time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	srv.Close()
+	require.ErrorIs(t, <-done, context.Canceled)
+
+	// Test: The handler timeout expires the context
+	config := DefaultConfig(0)
+	config.HandlerTimeout = 50 * time.Millisecond
+	srv = startServer(t, config, waitForCancel)
+	conn, _ = dial(t, srv)
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	require.NoError(t, err)
+	require.ErrorIs(t, <-done, context.DeadlineExceeded)
+}
@@ -0,0 +1,168 @@
+package templates
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"html/template"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/response"
+	"io/fs"
+	"os"
+	"path"
+)
+
+// Names of the layout and pages in the default set
+const (
+	DefaultLayout = "base.html"
+	MessagePage   = "message.html"
+	ListingPage   = "listing.html" // directory listing of the fileserver package
+)
+
+//go:embed default
+var defaultFS embed.FS
+
+var defaultSet = mustLoadDefault()
+
+// Page is the data of the default message page
+type Page struct {
+	Title   string
+	Heading string
+	Message string
+}
+
+// Set holds templates parsed once at load time. Every page is parsed with
+// every layout, so a page can be rendered in any of them. It is safe for
+// concurrent use.
+type Set struct {
+	pages map[string]*template.Template
+}
+
+// Load parses the layouts and pages matching the given glob patterns in
+// fsys. Pages are named after their file name, layouts after theirs too.
+func Load(fsys fs.FS, layouts, pages string) (*Set, error) {
+	base, err := template.New("").ParseFS(fsys, layouts)
+	if err != nil {
+		return nil, fmt.Errorf("templates: parsing layouts: %w", err)
+	}
+	pageFiles, err := fs.Glob(fsys, pages)
+	if err != nil {
+		return nil, fmt.Errorf("templates: %w", err)
+	}
+	if len(pageFiles) == 0 {
+		return nil, fmt.Errorf("templates: no page matches %q", pages)
+	}
+
+	s := &Set{pages: make(map[string]*template.Template, len(pageFiles))}
+	for _, file := range pageFiles {
+		t, err := base.Clone()
+		if err != nil {
+			return nil, fmt.Errorf("templates: %w", err)
+		}
+		if _, err := t.ParseFS(fsys, file); err != nil {
+			return nil, fmt.Errorf("templates: parsing %s: %w", file, err)
+		}
+		s.pages[path.Base(file)] = t
+	}
+	return s, nil
+}
+
+// LoadDir is Load for templates on disk under dir
+func LoadDir(dir, layouts, pages string) (*Set, error) {
+	return Load(os.DirFS(dir), layouts, pages)
+}
+
+// Default returns the embedded set with DefaultLayout, MessagePage and
+// ListingPage
+func Default() *Set {
+	return defaultSet
+}
+
+func mustLoadDefault() *Set {
+	fsys, err := fs.Sub(defaultFS, "default")
+	if err != nil {
+		panic(err)
+	}
+	s, err := Load(fsys, "layouts/*.html", "pages/*.html")
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// Render renders page in layout with data, or page on its own if layout is
+// empty. The output is buffered, so its length is known before it's sent.
+func (s *Set) Render(layout, page string, data any) ([]byte, error) {
+	t, ok := s.pages[page]
+	if !ok {
+		return nil, fmt.Errorf("templates: no page %q", page)
+	}
+	name := layout
+	if name == "" {
+		name = page
+	}
+	var buf bytes.Buffer
+	if err := t.ExecuteTemplate(&buf, name, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Write renders page in layout and sends it as a complete HTML response with
+// the exact Content-Length. h holds extra headers and may be nil. Nothing is
+// written if rendering fails, so the caller can still send an error.
+func (s *Set) Write(w *response.Writer, statusCode response.StatusCode, h *headers.Headers, layout, page string, data any) error {
+	body, err := s.Render(layout, page, data)
+	if err != nil {
+		return err
+	}
+	out := response.GetDefaultHeaders(len(body))
+	if h != nil {
+		// Extra headers replace the defaults, repeated ones are all kept
+		for _, f := range h.Fields() {
+			out.Del(f.Name)
+		}
+		for _, f := range h.Fields() {
+			out.Add(f.Name, f.Value)
+		}
+	}
+	if err := w.WriteStatusLine(statusCode); err != nil {
+		return err
+	}
+	if err := w.WriteHeaders(out); err != nil {
+		return err
+	}
+	return w.WriteBody(body)
+}
+
+// WritePage sends the default message page with data
+func WritePage(w *response.Writer, statusCode response.StatusCode, data Page) error {
+	return defaultSet.Write(w, statusCode, nil, DefaultLayout, MessagePage, data)
+}
+
+// WriteMessage sends the default message page for statusCode, headed by its
+// reason phrase, with message as the text. Headers describing other content,
+// like Content-Length or Content-Encoding, are dropped and others, like
+// Allow, kept. If the page can't be rendered a plain text 500 is sent
+// instead and the error returned.
+func WriteMessage(w *response.ResponseWriter, statusCode response.StatusCode, message string) error {
+	reason := response.ReasonPhrase(statusCode)
+	body, err := defaultSet.Render(DefaultLayout, MessagePage, Page{
+		Title:   fmt.Sprintf("%d %s", statusCode, reason),
+		Heading: reason,
+		Message: message,
+	})
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Del("Content-Encoding")
+	h.Del("Last-Modified")
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	if err != nil {
+		statusCode = response.StatusInternalServerError
+		body = []byte(response.ReasonPhrase(statusCode) + "\n")
+		h.Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	w.WriteHeader(statusCode)
+	w.Write(body)
+	return err
+}
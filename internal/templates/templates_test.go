@@ -0,0 +1,88 @@
+package templates
+
+import (
+	"bytes"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/response"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSet(t *testing.T) {
+	fsys := fstest.MapFS{
+		"layouts/main.html":  {Data: []byte(`<main>{{template "content" .}}</main>`)},
+		"layouts/plain.html": {Data: []byte(`{{template "content" .}}`)},
+		"pages/user.html":    {Data: []byte(`{{define "content"}}<b>{{.Name}}</b>{{end}}`)},
+		"pages/list.html":    {Data: []byte(`{{define "content"}}{{range .}}{{.}},{{end}}{{end}}`)},
+	}
+	s, err := Load(fsys, "layouts/*.html", "pages/*.html")
+	require.NoError(t, err)
+
+	// Test: Page in a layout, with escaped data
+	out, err := s.Render("main.html", "user.html", map[string]string{"Name": "<Tom & Jerry>"})
+	require.NoError(t, err)
+	assert.Equal(t, "<main><b>&lt;Tom &amp; Jerry&gt;</b></main>", string(out))
+
+	// Test: Same pages, other layout and data
+	out, err = s.Render("plain.html", "list.html", []int{1, 2, 3})
+	require.NoError(t, err)
+	assert.Equal(t, "1,2,3,", string(out))
+
+	// Test: Unknown page or layout
+	_, err = s.Render("main.html", "missing.html", nil)
+	require.Error(t, err)
+	_, err = s.Render("missing.html", "user.html", nil)
+	require.Error(t, err)
+
+	// Test: No page matching the pattern
+	_, err = Load(fsys, "layouts/*.html", "views/*.html")
+	require.Error(t, err)
+}
+
+func TestWrite(t *testing.T) {
+	// Test: Content-Length matches the escaped body
+	out := &bytes.Buffer{}
+	w := response.NewWriter(out)
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	data := Page{Title: "Q&A", Heading: "<Questions>", Message: "Don't panic"}
+	require.NoError(t, Default().Write(w, response.StatusOK, h, DefaultLayout, MessagePage, data))
+
+	head, body, ok := strings.Cut(out.String(), "\r\n\r\n")
+	require.True(t, ok)
+	assert.Contains(t, head, "Content-Length: "+strconv.Itoa(len(body))+"\r\n")
+	assert.Contains(t, head, "Content-Type: text/html; charset=utf-8\r\n")
+	assert.NotContains(t, head, "Content-Type: text/html\r\n")
+	assert.Contains(t, body, "<title>Q&amp;A</title>")
+	assert.Contains(t, body, "<h1>&lt;Questions&gt;</h1>")
+	assert.Contains(t, body, "<p>Don&#39;t panic</p>")
+}
+
+func TestWriteMessage(t *testing.T) {
+	// Test: Message page with the reason phrase, content headers dropped
+	out := &bytes.Buffer{}
+	w := response.NewWriter(out)
+	rw := response.NewResponseWriter(w)
+	rw.Header().Set("Allow", "GET")
+	rw.Header().Set("Content-Length", "1000")
+	rw.Header().Set("Content-Encoding", "gzip")
+	rw.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+	require.NoError(t, WriteMessage(rw, response.StatusMethodNotAllowed, "Not <here>"))
+	require.NoError(t, rw.Finish())
+
+	head, body, ok := strings.Cut(out.String(), "\r\n\r\n")
+	require.True(t, ok)
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 405 Method Not Allowed\r\n"))
+	assert.Contains(t, head, "Allow: GET\r\n")
+	assert.Contains(t, head, "Content-Type: text/html; charset=utf-8\r\n")
+	assert.Contains(t, head, "Content-Length: "+strconv.Itoa(len(body))+"\r\n")
+	assert.NotContains(t, head, "Content-Encoding")
+	assert.NotContains(t, head, "Last-Modified")
+	assert.Contains(t, body, "<title>405 Method Not Allowed</title>")
+	assert.Contains(t, body, "<p>Not &lt;here&gt;</p>")
+}